@@ -2,39 +2,150 @@ package sqlite3
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
 	"database/sql"
 	"database/sql/driver"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"math"
+	"math/big"
+	mrand "math/rand/v2"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type Driver struct {
+	opts []Option // applied to every connector it opens
 }
 
 type Connector struct {
-	name            string
+	binary          string        // sqlite3 executable
+	name            string        // database argument of sqlite3
+	file            string        // path of the database file, "" if there isn't one
+	pragmas         []string      // and dot-commands, run on every connection
+	busy            time.Duration // of .timeout, which another conn's transaction on a shared child is waited for, too
+	init            []string      // scripts run on every connection after the pragmas
+	args            []string      // extra flags of sqlite3
+	env             []string      // added to the environment of sqlite3
+	dir             string        // working directory of sqlite3
+	temp            string        // directory of a :temp: database
+	key             atomic.Value  // string, of an encrypted database for sqlcipher or SEE
+	err             error         // from the first invalid option
+	txlock          TxLock        // locking mode of BEGIN, unless the context says otherwise
+	json            bool          // queries are read in .mode json
+	rawText         bool          // text is given to Rows.Next as []byte
+	retry           RetryPolicy   // of statements failing as busy or locked
+	restart         bool          // a conn whose child exits starts another
+	report          func(error)   // told why a restarted child exited
+	watchdog        Watchdog      // of children printing nothing for too long
+	history         int           // bytes of traffic with each child to keep
+	tracer          *tracer       // of all traffic with children, nil if none
+	readSize        int           // of the reader's buffer to begin with
+	readMax         int           // the buffer may grow to
+	backlog         int           // bytes of output read ahead of Rows
+	maxRow          int           // bytes of a row, unlimited if 0
+	strictInt       bool          // an integer past int64 fails, rather than becoming a float64
+	strictReal      bool          // an infinite real fails, rather than becoming ±Inf
+	resync          bool          // a row which can't be parsed is skipped, not the end of the query
+	exact           Exactness     // of numbers, as float64 & int64 may not be, 0 if they'll do
+	uint64          Uint64Policy  // of uint64 arguments past int64
+	utf8            UTF8Policy    // of text which isn't valid UTF-8, either way
+	float           FloatPolicy   // of NaN & infinite float arguments
+	redact          bool          // arguments are left out of errors, history & traces
+	skipped         func(error)   // told why a row was skipped
 	driver          *Driver
 	register        chan *Conn
 	suspend, resume chan struct{}
 	locker          *sync.RWMutex
+
+	quit    chan struct{} // closed by Close
+	stopped chan struct{} // closed once the control routine returns
+	once    sync.Once
+
+	grace time.Duration // how long Conn.Close waits before each signal
+	idle  time.Duration // how long a child may sit idle, forever if zero
+
+	// timestamps are given as time.Time, and numbers in columns
+	// declared as dates too, with numericTime, in loc, or UTC if nil
+	parseTime, numericTime bool
+	loc                    *time.Location
+	timeLayout             string // of time.Time arguments, if not the default
+
+	bools       bool // columns declared BOOLEAN are given as bool
+	columnTypes bool // the declared types are looked up for Rows.ColumnType*
+	rawJSON     bool // the text of columns declared JSON is given as []byte
+
+	decoders     []decoder // the first matching a column has its values
+	typeDecoders bool      // some match columns by declared type
+	encoders     []Encoder // tried on each argument, before it's converted
+
+	slots    chan struct{} // one per child of a conn, nil if unlimited
+	wait     time.Duration // for a slot, as long as the dial context if negative
+	warm     int           // how many children to start ahead of Connect
+	spares   chan *spawned // of those children, nil if none
+	refilled chan struct{} // closed once the spares are gone, after Close
+
+	// without a file, as with :memory:, no other process can see the
+	// database, so every conn shares the child of this one, which runs one
+	// conn's statements at a time, and only its statements while it has a
+	// transaction open
+	mu     sync.Mutex
+	shared *Conn
 }
 
+// how long a child gets to exit after its input is closed, and again after SIGTERM
+const DefaultGracePeriod = 5 * time.Second
+
 type Conn struct {
 	connector *Connector
 	driver    *Driver
+	cmd       *exec.Cmd
 	ctl       chan job
 	pipeline  context.Context
 	cancel    context.CancelFunc
-	errs      [3]error
+	errs      [3]error // of the child exiting, the control routine & the reader
+	errsMu    sync.Mutex
+	tx        *Tx               // open transaction, nil if none
+	busy      <-chan struct{}   // done channel of the last job
+	reset     []string          // statements undoing per-query session changes
+	file      os.FileInfo       // the database file, once it exists
+	cookie    string            // line printed after each query
+	lines     int               // of input written to the child, as sqlite3 counts them in errors
+	heard     atomic.Int64      // unix nanoseconds of the child's last output
+	redactor  *strings.Replacer // of the last arguments bound, WithRedaction
+	opened    bool              // by Driver.Open, whose connector is closed with it
+	begun     bool              // a statement run may have begun a transaction, which ResetSession rolls back
+	held      atomic.Bool       // of the owner, while a transaction is open, which WithIdleTimeout waits out
+	reaped    atomic.Bool       // of the owner, once WithIdleTimeout ended its child
+	killed    atomic.Bool       // once a query's context ended its child, which makes the conn bad
+
+	sent, received *ring // the last of the traffic with the child, nil unless WithHistory
+	tail           *ring // the last of the child's output, for a ProcessExitError
+
+	owner   *Conn         // the conn which spawned the child, maybe this one
+	sharers int           // of the owner, conns still using its child
+	lease   chan struct{} // held while a shared child is in use, nil if not shared
+	leases  int
 
 	context.Context
 }
@@ -43,1175 +154,6517 @@ type Stmt struct {
 	query      string
 	conn       *Conn
 	semicolons []int
-	questions  []int
+	params     []param
+	inputs     int // largest parameter index, which is the number of distinct parameters
+	returning  bool
+	opts       StmtOptions
+	syntax     error // of a quote left open, which sqlite3 would wait for the rest of
+
+	mu      sync.Mutex
+	running map[*context.CancelFunc]struct{} // cancelled by Close
+	closed  bool
+}
+
+// ErrExited is returned when sqlite3 exits after being handed a statement.
+// Unlike driver.ErrBadConn, the statement may have run, so it isn't retried.
+var ErrExited = errors.New("sqlite3 exited before the statement finished")
+
+// ProcessExitError is how a child exited, when it didn't exit cleanly,
+// as Conn.Close and WithRestart's report say. sqlite3 prints its errors
+// where its output goes, so Output is the last of what it printed after
+// the last query to finish.
+type ProcessExitError struct {
+	Code   int            // exit status, -1 if a signal killed it
+	Signal syscall.Signal // which killed it, 0 if none did
+	Output string         // the last of what it printed
+	Err    error          // from exec.Cmd.Wait
+}
+
+// how much of a child's last output a ProcessExitError has
+const exitTail = 1 << 10
+
+func (e *ProcessExitError) Error() string {
+	var s string
+	if e.Signal != 0 {
+		s = fmt.Sprintf("sqlite3 was killed by signal %d (%s)", int(e.Signal), e.Signal)
+	} else {
+		s = fmt.Sprintf("sqlite3 exited with status %d", e.Code)
+	}
+	if e.Output != "" {
+		s += ": " + e.Output
+	}
+	return s
+}
+
+func (e *ProcessExitError) Unwrap() error {
+	return e.Err
+}
+
+// slices of a closed statement, for the next prepare to reuse
+type scratch struct {
+	params     []param
+	semicolons []int
+}
+
+var scratches = sync.Pool{
+	New: func() any {
+		return &scratch{
+			params:     make([]param, 0, 16),
+			semicolons: make([]int, 0, 16),
+		}
+	},
+}
+
+// placeholder in a query
+type param struct {
+	i, n  int    // index & length within the query
+	index int    // 1-based index of the argument it binds to
+	name  string // with its prefix, as in ":id", or "" for ?
+	stmt  int    // index of the statement it's in, not counting empty ones
 }
 
 type job struct {
-	ch     chan []byte
+	in     chan []byte // the query, on its way to the control routine
+	ch     chan []byte // output, from the reader routine
 	ctx    context.Context
 	cancel context.CancelFunc
+	done   chan struct{}     // closed once all of the job's output has been read
+	input  string            // the query as written to sqlite3
+	line   int               // of sqlite3's input, where input starts
+	source source            // of input, if the caller's query was rewritten
+	redact *strings.Replacer // of the values of the arguments in input, WithRedaction
+}
+
+// s, with the values of the job's arguments given as their parameters
+func (j *job) redacted(s string) string {
+	if j.redact == nil {
+		return s
+	}
+	return j.redact.Replace(s)
 }
 
 type Result struct {
 	conn *Conn
 	job
+
+	// output of a RETURNING clause
+	names []string
+	rows  [][]driver.Value
+	id    *int64 // last_insert_rowid() after it
 }
 
 type Tx struct {
 	*Conn
+	parent    *Tx    // enclosing transaction when nested
+	savepoint string // name of the SAVEPOINT standing in for a nested BEGIN
+	readonly  bool   // PRAGMA query_only was turned on by this transaction
+	done      bool
 }
 
 type Rows struct {
 	Result
-	Parser
+	parser
+
+	// row parsed ahead of Next
+	ahead    []driver.Value
+	aheadErr error
+	peeked   bool
+
+	query     string
+	stmts     []string  // of the query, each printing a result set, with "" for those not queries
+	columns   []*column // declared metadata, looked up on demand
+	json      bool      // the output is in .mode json
+	parseTime bool      // timestamps are given as time.Time
+	bools     bool      // columns declared BOOLEAN are given as bool
+	rawJSON   bool      // the text of columns declared JSON is given as []byte
+	jsonNames []string  // and of these columns
+	unsigned  bool      // negative integers are given as uint64
+	decoding  bool      // the connector's decoders apply
+	decoders  []Decoder // of each column of the result set, nil for those without
+
+	// with QualifiedNames, the header is kept as qualified, and the names
+	// of the queries' columns without qualifiers take its place
+	qualifies bool
+	qualified []string
+	names     [][]string // of each query's, in order
+}
 
-	// names of rows
-	names []string
+// declared metadata of a result column
+type column struct {
+	decl    string // declared type, as in VARCHAR(255)
+	notnull bool
 }
 
+// Parser reads the output of sqlite3 -quote -header, as Rows does: a line of
+// the column names, then a line a row, with a line starting with # between
+// the output of two statements. It's fed the output in pieces of any size,
+// and gives back each row once the whole of it has been fed.
 type Parser struct {
+	parser
+}
+
+// the state of parsing output, which Rows reads from its job
+type parser struct {
 	// parsing state
 	s, i, n int // state, index into buf, n - number of rows processed
 
+	taken int // bytes of output before buf
+	start int // of the row being parsed, as taken+i
+	at    int // of the value being parsed, as taken+i
+
+	header []string // names of the columns of the current result set
+	next   bool     // the current result set ended at a separator, so another follows
+
 	// these are kept around to avoid re-allocating
-	str  strings.Builder
-	buf  []byte
-	blob []byte
+	str   *bytes.Buffer // from the pool of buffers, until Close
+	buf   []byte
+	blobs [][]byte // of the last row, by column, whose memory the next row's take
+	raw   []byte   // text of the last row, with raw text, which the next row overwrites
+
+	// after a row failed, the rest of it is skipped, up to a newline outside a string
+	skip, quoted bool
+	broken       error // what the row failed of, which is returned from then on without resync
+	sets         int   // separators passed, which is the statement the output is of
+
+	// as the connector's options say
+	rawText    bool // text is given as []byte, out of raw
+	maxRow     int
+	strictInt  bool
+	strictReal bool
+	resync     bool
+	exact      Exactness
+	utf8       UTF8Policy
+
+	more  func() error                  // puts more of the output in buf, or errShort
+	fail  func(s string) error          // the error of a line sqlite3 printed
+	probe func(n int) ([]string, error) // the header of statement n, which printed no rows, nil if it isn't a query
 }
 
-type ParseError struct {
-	msg string
-	Parser
-}
+// ErrIncomplete is returned by Parser.Next when the output fed so far
+// ends before the next row does
+var ErrIncomplete = errors.New("sqlite3: incomplete row")
 
-func init() {
-	sql.Register("sqlite3", &Driver{})
-}
+// the parser has used up buf, and has nowhere to get more
+var errShort = errors.New("sqlite3: short output")
 
-func (d *Driver) Open(name string) (driver.Conn, error) {
-	c, err := d.OpenConnector(name)
-	if err != nil {
-		return nil, err
+// NewParser returns a Parser of the output of a connector configured by opts,
+// of which WithRawText, WithMaxRowSize, WithStrictIntegers, WithStrictReals,
+// WithResync, WithExactNumbers & WithUTF8 have a say in the rows given
+func NewParser(opts ...Option) (*Parser, error) {
+	var c Connector
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if c.err != nil {
+		return nil, c.err
 	}
-	return c.Connect(context.Background())
+
+	return &Parser{parser{
+		str:        new(bytes.Buffer),
+		rawText:    c.rawText,
+		maxRow:     c.maxRow,
+		strictInt:  c.strictInt,
+		strictReal: c.strictReal,
+		resync:     c.resync,
+		exact:      c.exact,
+		utf8:       c.utf8,
+	}}, nil
 }
 
-func (d *Driver) OpenConnector(name string) (driver.Connector, error) {
-	c := Connector{
-		name:     name,
-		driver:   d,
-		register: make(chan *Conn),
-		suspend:  make(chan struct{}),
-		resume:   make(chan struct{}),
+// Feed gives the parser the next of the output, which it copies
+func (p *Parser) Feed(b []byte) {
+	// what's been parsed is dropped, once it's most of buf
+	if p.i > 0 && p.i >= len(p.buf)/2 {
+		n := copy(p.buf, p.buf[p.i:])
+		p.taken += p.i
+		p.buf, p.i = p.buf[:n], 0
 	}
+	p.buf = append(p.buf, b...)
+}
 
-	go c.control()
-	return &c, nil
+// Columns returns the names of the columns of the current result set,
+// once Next has read its header
+func (p *Parser) Columns() []string {
+	return p.header
 }
 
-func (c *Connector) control() {
-	conns := make(map[*Conn]struct{})
-	var max int
+// Next returns the next row of the output, reading the header before it.
+// At the end of a statement's output, it returns io.EOF, after which it
+// goes on to the next statement's, which has a header of its own.
+// An error sqlite3 printed is returned as an *Error, and output which
+// makes no sense as a *ParseError. That, or a row failing as the options
+// say, fails each call after too, unless WithResync, with which the rest
+// of the row is skipped, and the next call goes on from the row after.
+// Whatever it's fed, Next doesn't panic.
+//
+// When the output fed so far ends before the row does, it returns ErrIncomplete,
+// and starts the row over once fed more; with the rest of the output fed,
+// ErrIncomplete means there are no more rows. The values of a row are its own,
+// but for raw text, and blobs, which the next row may overwrite.
+func (p *Parser) Next() ([]driver.Value, error) {
+	if p.next {
+		p.next, p.n, p.header = false, 0, nil
+	}
 
-	for conn := range c.register {
-		if _, ok := conns[conn]; ok {
-			delete(conns, conn)
-			continue
-		} else {
-			conns[conn] = struct{}{}
-		}
+	// a row skipped is gone for good, unlike one only partly fed
+	if err := p.resynchronize(); err == errShort {
+		return nil, ErrIncomplete
+	} else if err != nil {
+		return nil, err
+	}
 
-		if n := len(conns); n <= max {
-			continue
-		} else {
-			max = n
+	for {
+		var dest []driver.Value
+		if p.n > 0 {
+			dest = make([]driver.Value, len(p.header))
 		}
 
-		switch max {
-		case 1:
-			c.resume <- struct{}{}
-		case 2:
-			// the connector is making a second new connection
-			// the first connection's controller is reading from the suspend channel
-			// when we suspend the first connection, it sets the RWMutex on the driver
-			// and then closes the resume channel c.suspend<-struct{}{}
-			c.suspend <- struct{}{}
-		default:
-			continue
+		i, s, header := p.i, p.s, len(p.header)
+		switch err := p.parse(dest); {
+		case err == errShort:
+			p.i, p.s, p.header = i, s, p.header[:header]
+			p.skip = false
+			p.str.Reset()
+			return nil, ErrIncomplete
+		case err != nil:
+			return nil, err
+		case dest != nil:
+			return dest, nil
 		}
 	}
 }
 
-func makePipes(p []*os.File) (err error) {
-	if len(p)%2 != 0 {
-		return fmt.Errorf("pipe array must be divisible by 2")
-	}
+// for building queries & strings, kept between them
+var buffers = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
 
-	var i int
-	for i = 0; i+1 < len(p) && err == nil; i += 2 {
-		p[i], p[i+1], err = os.Pipe()
+// put a buffer back in the pool, unless it's grown too big to keep around
+func release(buf *bytes.Buffer) {
+	if buf.Cap() <= 64<<10 {
+		buf.Reset()
+		buffers.Put(buf)
 	}
+}
 
-	if err == nil {
-		return
-	}
+// locking mode of BEGIN
+type TxLock string
 
-	for i -= 3; i > 0; i-- {
-		p[i].Close()
-	}
+const (
+	Deferred  TxLock = "DEFERRED"
+	Immediate TxLock = "IMMEDIATE"
+	Exclusive TxLock = "EXCLUSIVE"
+)
 
-	return
-}
+type txLockKey struct{}
 
-type ReadCloser struct {
-	bufio.Reader
-	f *os.File
+// WithTxLock returns a context which makes BeginTx use the given locking mode
+func WithTxLock(ctx context.Context, lock TxLock) context.Context {
+	return context.WithValue(ctx, txLockKey{}, lock)
 }
 
-func (r *ReadCloser) Close() error {
-	return r.f.Close()
+// options for a single statement, attached to the context given to PrepareContext
+type StmtOptions struct {
+	Timeout   time.Duration // limit on each execution, none if zero
+	Bail      bool          // stop a multi-statement Exec at the first failing statement
+	BailOn    bool          // like Bail, in one go under .bail on, see Stmt.bail
+	JSON      bool          // read the rows in .mode json, where blobs come back as text
+	RawText   bool          // give text as []byte, valid until the next call to Next
+	ParseTime bool          // give timestamps as time.Time, as WithParseTime says
+	Booleans  bool          // give columns declared BOOLEAN as bool, as WithBooleans says
+	RawJSON   bool          // give the text of columns declared JSON as []byte, as WithRawJSON says
+
+	// names of result columns whose text is given as []byte, holding JSON
+	JSONColumns []string
+
+	// give negative integers as the uint64 of the same bits, as Uint64Wrap stores them
+	Unsigned bool
+
+	// the connector's decoders apply, as they do to all but the driver's own queries
+	decode bool
+
+	// name the columns of tables as table.column, or alias.column, as PRAGMA
+	// full_column_names does with short_column_names off, which Rows.QualifiedColumns
+	// gives, while Columns gives the names as they'd otherwise be
+	QualifiedNames bool
+
+	// each statement that's a query prints its header, which sqlite3 doesn't without rows
+	headers bool
 }
 
-func (c *Connector) Connect(dial context.Context) (driver.Conn, error) {
-	var err error
-	var pipes [4]*os.File
-
-	cmd := exec.Command("sqlite3", "-quote", "-header", string(c.name))
-
-	if err = makePipes(pipes[:]); err != nil {
-		return nil, err
-	}
+type stmtOptionsKey struct{}
 
-	cmd.Stdin = pipes[0]
-	cmd.Stdout = pipes[3]
-	cmd.Stderr = pipes[3]
-	var stdin io.WriteCloser = pipes[1]
-	var outerr io.ReadCloser = pipes[2]
+// WithStmtOptions returns a context which makes PrepareContext apply opts to the statement
+func WithStmtOptions(ctx context.Context, opts StmtOptions) context.Context {
+	return context.WithValue(ctx, stmtOptionsKey{}, opts)
+}
 
-	if err = cmd.Start(); err != nil {
-		for _, f := range pipes {
-			f.Close()
-		}
-		return nil, err
-	} else {
-		pipes[0].Close()
-		pipes[3].Close()
-	}
+// Error is an error printed by sqlite3. It only prints a result code after
+// some messages, so the codes are otherwise guessed from the message.
+type Error struct {
+	Code         ErrNo         // primary result code, ErrError if unknown
+	ExtendedCode ErrNoExtended // the primary code, unless the message tells
+	Msg          string        // without sqlite3's prefix & code
+	Query        string        // the failing statement, "" if unknown
+	Statement    int           // index of the failing statement, not counting empty ones
+	Line         int           // of the query as written, where the statement starts, 0 if unknown
+	Offset       int           // in bytes, into the query as written, where the statement starts
+
+	printed string
+	at      int // line of sqlite3's input in printed
+}
 
-	ctx, mark := context.WithCancel(context.Background())
+// ErrNo is a primary result code, as ErrBusy is SQLITE_BUSY
+type ErrNo int
+
+// ErrNoExtended is an extended result code, as ErrConstraintUnique is SQLITE_CONSTRAINT_UNIQUE
+type ErrNoExtended int
+
+const (
+	ErrError      ErrNo = 1  // SQL error or missing database
+	ErrInternal   ErrNo = 2  // internal logic error in sqlite
+	ErrPerm       ErrNo = 3  // access permission denied
+	ErrAbort      ErrNo = 4  // callback routine requested an abort
+	ErrBusy       ErrNo = 5  // the database file is locked
+	ErrLocked     ErrNo = 6  // a table in the database is locked
+	ErrNomem      ErrNo = 7  // a malloc() failed
+	ErrReadonly   ErrNo = 8  // attempt to write a readonly database
+	ErrInterrupt  ErrNo = 9  // operation terminated by sqlite3_interrupt()
+	ErrIoErr      ErrNo = 10 // some kind of disk I/O error occurred
+	ErrCorrupt    ErrNo = 11 // the database disk image is malformed
+	ErrNotFound   ErrNo = 12 // unknown opcode in sqlite3_file_control()
+	ErrFull       ErrNo = 13 // insertion failed because database is full
+	ErrCantOpen   ErrNo = 14 // unable to open the database file
+	ErrProtocol   ErrNo = 15 // database lock protocol error
+	ErrEmpty      ErrNo = 16 // internal use only
+	ErrSchema     ErrNo = 17 // the database schema changed
+	ErrTooBig     ErrNo = 18 // string or blob exceeds size limit
+	ErrConstraint ErrNo = 19 // abort due to constraint violation
+	ErrMismatch   ErrNo = 20 // data type mismatch
+	ErrMisuse     ErrNo = 21 // library used incorrectly
+	ErrNoLFS      ErrNo = 22 // uses OS features not supported on host
+	ErrAuth       ErrNo = 23 // authorization denied
+	ErrFormat     ErrNo = 24 // not used
+	ErrRange      ErrNo = 25 // 2nd parameter to sqlite3_bind out of range
+	ErrNotADB     ErrNo = 26 // file opened that is not a database file
+)
 
-	// this is the context strictly for the stdin -> sqlite -> stdout pipeline
-	pipeline, cancel := context.WithCancel(context.Background())
+const (
+	ErrConstraintCheck      = ErrNoExtended(ErrConstraint | 1<<8)
+	ErrConstraintForeignKey = ErrNoExtended(ErrConstraint | 3<<8)
+	ErrConstraintNotNull    = ErrNoExtended(ErrConstraint | 5<<8)
+	ErrConstraintPrimaryKey = ErrNoExtended(ErrConstraint | 6<<8)
+	ErrConstraintUnique     = ErrNoExtended(ErrConstraint | 8<<8)
+)
 
-	conn := Conn{
-		connector: c,
-		driver:    c.driver,
-		ctl:       make(chan job),
-		Context:   ctx,
-		pipeline:  pipeline,
-		cancel:    cancel,
-	}
+func (e ErrNo) Error() string {
+	return fmt.Sprintf("sqlite3 result code %d", int(e))
+}
 
-	w := make(chan []byte)
-	r := make(chan job)
+func (e ErrNoExtended) Error() string {
+	return fmt.Sprintf("sqlite3 extended result code %d", int(e))
+}
 
-	c.register <- &conn
+func (e *Error) Error() string {
+	return e.printed
+}
 
-	wg := &sync.WaitGroup{}
+// errors.Is(err, ErrBusy) and errors.Is(err, ErrConstraintUnique) match on the codes
+func (e *Error) Is(target error) bool {
+	switch t := target.(type) {
+	case ErrNo:
+		return e.Code == t
+	case ErrNoExtended:
+		return e.ExtendedCode == t
+	}
+	return false
+}
 
-	wg.Add(1)
-	go func() {
-		conn.errs[0] = cmd.Wait()
-		cancel()
-		wg.Done()
-	}()
+// IsBusy reports whether err is sqlite3 finding the database locked by another connection
+func IsBusy(err error) bool {
+	return errors.Is(err, ErrBusy)
+}
 
-	wg.Add(1)
-	go func() {
-		conn.errs[1] = conn.write(stdin, w)
-		cancel()
-		stdin.Close()
-		wg.Done()
-	}()
+// IsLocked reports whether err is sqlite3 finding a table locked within the connection
+func IsLocked(err error) bool {
+	return errors.Is(err, ErrLocked)
+}
 
-	wg.Add(1)
-	go func() {
-		conn.errs[2] = conn.read(outerr, r)
-		cancel()
-		outerr.Close()
-		wg.Done()
-	}()
+// IsReadOnly reports whether err is a write to a readonly database
+func IsReadOnly(err error) bool {
+	return errors.Is(err, ErrReadonly)
+}
 
-	wg.Add(1)
-	go func() {
-		<-c.resume
-		conn.control(pipeline, r, w)
-		wg.Done()
-	}()
+// IsInterrupt reports whether err is sqlite3 being interrupted
+func IsInterrupt(err error) bool {
+	return errors.Is(err, ErrInterrupt)
+}
 
-	go func() {
-		wg.Wait()
-		c.register <- &conn // unregister
-		mark()
-	}()
+// IsNotADB reports whether err is sqlite3 opening something other than a database,
+// as an encrypted database opened with the wrong key
+func IsNotADB(err error) bool {
+	return errors.Is(err, ErrNotADB)
+}
 
-	if err == nil {
-		err = dial.Err()
-	}
+// IsConstraint reports whether err is a constraint violation of any kind
+func IsConstraint(err error) bool {
+	return errors.Is(err, ErrConstraint)
+}
 
-	if err != nil {
-		cancel()
-	}
+func IsConstraintUnique(err error) bool {
+	return errors.Is(err, ErrConstraintUnique)
+}
 
-	return &conn, err
+func IsConstraintNotNull(err error) bool {
+	return errors.Is(err, ErrConstraintNotNull)
 }
 
-func (c *Connector) Driver() driver.Driver {
-	return c.driver
+func IsConstraintForeignKey(err error) bool {
+	return errors.Is(err, ErrConstraintForeignKey)
+}
 
+func IsConstraintCheck(err error) bool {
+	return errors.Is(err, ErrConstraintCheck)
 }
 
-// control routine
-func (c *Conn) control(ctx context.Context, r chan job, w chan []byte) {
-	defer close(r)
-	defer close(w)
+// codes of messages sqlite3 prints without one
+var messages = []struct {
+	msg  string
+	code ErrNoExtended
+}{
+	{"UNIQUE constraint failed", ErrConstraintUnique},
+	{"NOT NULL constraint failed", ErrConstraintNotNull},
+	{"CHECK constraint failed", ErrConstraintCheck},
+	{"FOREIGN KEY constraint failed", ErrConstraintForeignKey},
+	{"constraint failed", ErrNoExtended(ErrConstraint)},
+	{"database is locked", ErrNoExtended(ErrBusy)},
+	{"database table is locked", ErrNoExtended(ErrLocked)},
+	{"out of memory", ErrNoExtended(ErrNomem)},
+	{"readonly database", ErrNoExtended(ErrReadonly)},
+	{"interrupted", ErrNoExtended(ErrInterrupt)},
+	{"disk I/O error", ErrNoExtended(ErrIoErr)},
+	{"malformed", ErrNoExtended(ErrCorrupt)},
+	{"database or disk is full", ErrNoExtended(ErrFull)},
+	{"unable to open database", ErrNoExtended(ErrCantOpen)},
+	{"too big", ErrNoExtended(ErrTooBig)},
+	{"datatype mismatch", ErrNoExtended(ErrMismatch)},
+	{"not authorized", ErrNoExtended(ErrAuth)},
+	{"file is not a database", ErrNoExtended(ErrNotADB)},
+}
 
-	var job job
-	var ok bool
+// the error sqlite3 printed as s, which begins with a message like
+// "Runtime error near line 3: UNIQUE constraint failed: t.a (19)",
+// and may go on with lines pointing at the error. input is the query
+// sqlite3 was given, starting at the given line of what it read.
+func newError(s, input string, line int) *Error {
+	s, _, _ = strings.Cut(s, "\n")
+	s = strings.TrimSuffix(s, "\r")
+	e := &Error{printed: s, Code: ErrError, ExtendedCode: ErrNoExtended(ErrError)}
+
+	msg := s
+	for _, prefix := range []string{"Parse error", "Runtime error", "Error:"} {
+		if rest, ok := strings.CutPrefix(msg, prefix); ok {
+			msg = strings.TrimSpace(rest)
+			break
+		}
+	}
 
-	for {
-		select {
-		case job, ok = <-c.ctl:
-			if !ok {
-				return
-			}
-		case <-c.connector.suspend:
-			c.connector.suspend = nil
-			if ok { // job is valid
-				<-job.ctx.Done()
-				// last job is finished
+	// -safe refusals are just "line N: ..."
+	at := 0
+	if rest, ok := strings.CutPrefix(msg, "near line "); ok || strings.HasPrefix(msg, "line ") {
+		if !ok {
+			rest = strings.TrimPrefix(msg, "line ")
+		}
+		if n, rest, ok := strings.Cut(rest, ":"); ok {
+			if n, err := strconv.Atoi(n); err == nil {
+				at, msg = n, strings.TrimSpace(rest)
 			}
-			c.connector.locker = &sync.RWMutex{}
-			close(c.connector.resume)
-			continue
-		case <-ctx.Done():
-			return
 		}
+	}
 
-		select {
-		case w <- <-job.ch:
-			// query was received from job.ch & passed to the writer
-		case <-ctx.Done():
-			return
+	if i := strings.LastIndex(msg, " ("); i >= 0 && strings.HasSuffix(msg, ")") {
+		if n, err := strconv.Atoi(msg[i+2 : len(msg)-1]); err == nil {
+			e.Code, e.ExtendedCode = ErrNo(n&0xff), ErrNoExtended(n)
+			msg = msg[:i]
 		}
+	}
 
-		select {
-		case r <- job:
-		case <-ctx.Done():
-			return
+	for _, m := range messages {
+		if strings.Contains(msg, m.msg) {
+			if e.Code == ErrError || e.Code == ErrNo(m.code&0xff) {
+				e.Code, e.ExtendedCode = ErrNo(m.code&0xff), m.code
+			}
+			break
 		}
 	}
-}
 
-// writer routine
-func (c *Conn) write(stdin io.Writer, w chan []byte) error {
-	t := "\n.print \"'''\"\n"
-	var buf []byte
+	e.Msg, e.at = msg, at
+	if at >= line && line > 0 {
+		e.Query = statement(input, at-line)
 
-	for cmd := range w {
-		n := len(t) + len(cmd)
-		if len(buf) < n {
-			buf = make([]byte, n)
-			copy(buf[len(cmd):], t) // copy trailer to end of buffer
+		// the statements ended before the line it starts on
+		p := 0
+		for n := at - line; n > 0; n-- {
+			p += strings.IndexByte(input[p:], '\n') + 1
+		}
+		e.Statement = len(ends(input[:p])) - 2*strings.Count(input[:p], qualify)
+	}
+	return e
+}
+
+// point e into query, where the input sqlite3 was given starts at statement
+// first, and have the error say the line of query rather than of sqlite3's input
+func (e *Error) locate(query string, first int) {
+	e.Statement += first
+
+	var starts []int
+	var b body
+	p, begun := 0, false
+	for _, t := range tokenize(query) {
+		p += strings.Index(query[p:], t)
+		if t != ";" {
+			b.word(t)
 		}
+		if t == ";" && b.end() {
+			begun = false
+		} else if !begun {
+			starts = append(starts, p)
+			begun = true
+		}
+		p += len(t)
+	}
+	if e.Statement >= len(starts) {
+		return
+	}
 
-		buf := buf[len(buf)-n:]
-		copy(buf, cmd)
+	e.Offset = starts[e.Statement]
+	e.Line = strings.Count(query[:e.Offset], "\n") + 1
+	if e.at > 0 {
+		at := fmt.Sprintf("line %d:", e.at)
+		e.printed = strings.Replace(e.printed, at, fmt.Sprintf("line %d:", e.Line), 1)
+		e.at = e.Line
+	}
+}
 
-		if _, err := stdin.Write(buf); err != nil {
-			return err
+// offsets of the semicolons ending the statements of query, but empty ones
+func ends(query string) []int {
+	var semicolons []int
+	var b body
+	p, empty := 0, true
+	for _, t := range tokenize(query) {
+		p += strings.Index(query[p:], t)
+		if t != ";" {
+			b.word(t)
+			empty = false
+		} else if b.end() && !empty {
+			semicolons = append(semicolons, p)
+			empty = true
 		}
+		p += len(t)
 	}
-	return nil
+	return semicolons
 }
 
-// reader routine
-func (c *Conn) read(r io.Reader, ch <-chan job) error {
-	var i, j, n, m int // r - record index - magic cookie level denoting end-of-query
-	var err error
+// a statement followed a word at a time, for the BEGIN ... END of the
+// body of a trigger, whose semicolons don't end the statement
+type body struct {
+	words   int  // of the statement so far
+	create  bool // the statement is a CREATE
+	trigger bool // CREATE [TEMP] TRIGGER
+	depth   int  // of the BEGINs & CASEs in a trigger, each closed by an END
+}
 
-	const size int = 4096
-	var refill int = int(math.Ceil(float64(size) / 4 * 3))
-	var buf []byte = make([]byte, size)
+// the next word of the statement
+func (b *body) word(w string) {
+	switch {
+	case b.words == 0:
+		b.create = strings.EqualFold(w, "CREATE")
+	case b.create && b.words <= 2 && strings.EqualFold(w, "TRIGGER"):
+		b.trigger = true
+	case !b.trigger:
+	case strings.EqualFold(w, "BEGIN"), strings.EqualFold(w, "CASE"):
+		b.depth++
+	case strings.EqualFold(w, "END"):
+		b.depth--
+	}
+	b.words++
+}
 
-	cookie := []byte("'''\n")
-	var pc byte = '\n'
-	var job job
-	var ok bool
+// whether a semicolon ends the statement, which the next starts after
+func (b *body) end() bool {
+	if b.depth > 0 {
+		return false
+	}
+	*b = body{}
+	return true
+}
 
-	if size < len(cookie)+1 { // +1 because cookie is preceded by a new line
-		panic("buffer lenth must be greater than cookie size")
+// the error printed as s for the job's query
+func (j *job) error(s string) *Error {
+	e := newError(s, j.input, j.line)
+	if e.Query != "" && j.source.query != "" {
+		e.locate(j.source.query, j.source.first)
+	}
+	if j.redact != nil {
+		e.Msg, e.Query, e.printed = j.redacted(e.Msg), j.redacted(e.Query), j.redacted(e.printed)
 	}
+	return e
+}
 
-	for {
-		if !ok {
-			job, ok = <-ch
-		}
+// where the input of a job came from: the query as the caller wrote it,
+// and which of its statements the input starts at, for errors to point into
+type source struct {
+	query string
+	first int
+}
 
-		// if the buffer is 3/4ths its original capacity
-		if len(buf) < refill {
-			tmp := make([]byte, size)
-			copy(tmp, buf[:j])
-			buf = tmp
+type sourceKey struct{}
+
+// ctx, saying its queries come from query, unless it already says where from
+func from(ctx context.Context, query string, first int) context.Context {
+	if _, ok := ctx.Value(sourceKey{}).(source); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, sourceKey{}, source{query, first})
+}
+
+// the statement starting on line n of query, counting from 0
+func statement(query string, n int) string {
+	for ; n > 0; n-- {
+		_, query, _ = strings.Cut(query, "\n")
+	}
+
+	p := 0
+	var b body
+	for _, t := range tokenize(query) {
+		p += strings.Index(query[p:], t) + len(t)
+		if t != ";" {
+			b.word(t)
+		} else if b.end() {
+			break
 		}
+	}
+	// without the semicolon, which may be one the driver added
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(query[:p]), ";"))
+}
 
-		if i+m < j && ok {
-			// still got bytes left to process
-		} else if n, err = r.Read(buf[j:]); err == io.EOF {
-			if i+m < j {
-				s := strings.TrimSpace(string(buf[i+m:j]))
-				return fmt.Errorf("%s", s)
-			}
-			return nil
-		} else if err != nil {
-			return err
-		} else {
-			j += n
+type ParseError struct {
+	msg string
+
+	Row     int    // of the result set, from 1, or 0 for the header
+	Column  int    // index of the value the row failed at, or -1 between rows
+	Name    string // of the column, if the header has it
+	Excerpt string // the value up to where it failed, of at most 32 bytes
+
+	Query string // whose output it was
+
+	// the last of what went to & came from sqlite3, with WithHistory
+	Sent, Received []byte
+}
+
+func init() {
+	sql.Register("sqlite3", &Driver{})
+}
+
+// RegisterDriver registers the driver with database/sql under another name,
+// which sql.Open then configures with opts; like sql.Register, it panics
+// if the name is taken, as "sqlite3" is when mattn/go-sqlite3 is imported too
+func RegisterDriver(name string, opts ...Option) {
+	sql.Register(name, &Driver{opts: opts})
+}
+
+func (d *Driver) Open(name string) (driver.Conn, error) {
+	c, err := d.connector(name, d.opts)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.Connect(context.Background())
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// nothing else has the connector, or the directory of a :temp: database
+	conn.(*Conn).opened = true
+	return conn, nil
+}
+
+func (d *Driver) OpenConnector(name string) (driver.Connector, error) {
+	c, err := d.connector(name, d.opts)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Option configures a Connector made by NewConnector
+type Option func(*Connector)
+
+// WithBinary runs the given sqlite3 executable instead of the one in $PATH
+func WithBinary(path string) Option {
+	return func(c *Connector) {
+		c.binary = path
+	}
+}
+
+// WithPragma sets a pragma on every connection, after those of the DSN
+func WithPragma(name, value string) Option {
+	return func(c *Connector) {
+		c.pragmas = append(c.pragmas, "PRAGMA "+name+" = "+value+";")
+	}
+}
+
+// WithInit runs a script on every new connection, after its pragmas and before
+// database/sql gets it, e.g. to ATTACH databases or create temp tables
+func WithInit(script string) Option {
+	return func(c *Connector) {
+		c.init = append(c.init, script)
+	}
+}
+
+// WithArgs passes extra flags to sqlite3, as in WithArgs("-readonly", "-cmd", "PRAGMA cache_size = 1000").
+// Flags changing the output the driver reads, like -csv or -bail, are refused by NewConnector.
+func WithArgs(args ...string) Option {
+	return func(c *Connector) {
+		c.args = append(c.args, args...)
+	}
+}
+
+// flags of sqlite3 which take values, and how many
+var flagValues = map[string]int{
+	"cmd": 1, "escape": 1, "init": 1, "maxsize": 1, "mmap": 1,
+	"nonce": 1, "vfs": 1, "lookaside": 2, "pagecache": 2,
+}
+
+// flags of sqlite3 which change its output, or what it does with its input
+var flagConflicts = map[string]bool{
+	"A": true, "ascii": true, "bail": true, "box": true, "column": true,
+	"csv": true, "echo": true, "help": true, "html": true, "interactive": true,
+	"json": true, "line": true, "list": true, "markdown": true, "memtrace": true,
+	"newline": true, "noheader": true, "nullvalue": true, "pcachetrace": true,
+	"separator": true, "stats": true, "table": true, "tabs": true,
+	"version": true, "vfstrace": true, "zip": true,
+}
+
+// check extra flags can be given to sqlite3 alongside -quote -header
+func checkArgs(args []string) error {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		flag, ok := strings.CutPrefix(arg, "-")
+		if !ok || flag == "-" {
+			return fmt.Errorf("sqlite3 argument %q is not a flag", arg)
 		}
+		flag = strings.TrimPrefix(flag, "-")
 
-		if !ok {
-			continue
+		if flagConflicts[flag] {
+			return fmt.Errorf("sqlite3 flag %s conflicts with the driver's -quote -header", arg)
+		}
+		if n := flagValues[flag]; i+n >= len(args) {
+			return fmt.Errorf("sqlite3 flag %s is missing its value", arg)
+		} else {
+			i += n
 		}
+	}
+	return nil
+}
 
-		for i+m < j {
-			c := buf[i+m]
-			if m == 0 && pc != '\n' {
-				i++
-			} else if m >= len(cookie) {
-				pc = c
-				break
-			} else if c == cookie[m] {
-				m++
-			} else {
-				i += m + 1
-				m = 0
-			}
-			pc = c
+// WithEnv adds variables like "TMPDIR=/var/tmp" to the environment sqlite3 inherits
+func WithEnv(vars ...string) Option {
+	return func(c *Connector) {
+		c.env = append(c.env, vars...)
+	}
+}
+
+// WithDir runs sqlite3 in dir, which relative database paths are then relative to
+func WithDir(dir string) Option {
+	return func(c *Connector) {
+		c.dir = dir
+	}
+}
+
+// WithKey sets the key of an encrypted database, when the binary is sqlcipher
+// or a build of sqlite3 with SEE; it's given with PRAGMA key before anything
+// else, and left out of WithTrace's output, the history and errors
+func WithKey(key string) Option {
+	return func(c *Connector) {
+		c.key.Store(key)
+	}
+}
+
+// WithCacheSize sets the page cache of each connection, in pages,
+// or in KiB if negative, as with PRAGMA cache_size
+func WithCacheSize(n int) Option {
+	return WithPragma("cache_size", strconv.Itoa(n))
+}
+
+// WithPageSize sets the page size of a new database, a power of two from 512 to 65536
+func WithPageSize(n int) Option {
+	return func(c *Connector) {
+		if n < 512 || n > 65536 || n&(n-1) != 0 {
+			c.invalid(fmt.Errorf("page size %d isn't a power of two from 512 to 65536", n))
+			return
 		}
+		// before anything, like journal_mode=WAL, writes the first page
+		c.pragmas = append([]string{"PRAGMA page_size = " + strconv.Itoa(n) + ";"}, c.pragmas...)
+	}
+}
 
-		if i > 0 {
-			select {
-			case job.ch <- buf[:i]:
-			case <-job.ctx.Done():
-			}
+// WithMmapSize sets how many bytes of the database are memory-mapped, 0 for none
+func WithMmapSize(n int64) Option {
+	return func(c *Connector) {
+		if n < 0 {
+			c.invalid(fmt.Errorf("mmap size %d is negative", n))
+			return
 		}
+		WithPragma("mmap_size", strconv.FormatInt(n, 10))(c)
+	}
+}
 
-		if m >= len(cookie) {
-			close(job.ch)
-			ok = false
-			i += m
-			m = 0
+// WithJournalSizeLimit sets how many bytes of a journal or WAL file
+// are kept after a transaction, or -1 for no limit
+func WithJournalSizeLimit(n int64) Option {
+	return func(c *Connector) {
+		if n < -1 {
+			c.invalid(fmt.Errorf("journal size limit %d is less than -1", n))
+			return
 		}
+		WithPragma("journal_size_limit", strconv.FormatInt(n, 10))(c)
+	}
+}
 
-		buf = buf[i:]
-		j -= i
-		i = 0
+// keep the first error of the options, for NewConnector to return
+func (c *Connector) invalid(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
 
+// WithIdleTimeout ends children which have run nothing for d, outside of a
+// transaction; each is respawned when its conn is next used. It doesn't apply
+// to :memory:.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(c *Connector) {
+		c.idle = d
 	}
 }
 
-func (c *Conn) ResetSession(dial context.Context) error {
-	select {
-	case <-c.pipeline.Done():
-		return driver.ErrBadConn
-	default:
-		return nil
+// WithMaxConns limits the connector to n children besides those of WithWarm,
+// in case sql.DB's own limit isn't set. Connect waits up to wait for one
+// to close, or as long as its context allows if wait is negative, and then
+// fails with ErrTooManyConns.
+func WithMaxConns(n int, wait time.Duration) Option {
+	return func(c *Connector) {
+		if n < 1 {
+			c.invalid(fmt.Errorf("connection limit %d is less than 1", n))
+			return
+		}
+		c.slots = make(chan struct{}, n)
+		c.wait = wait
 	}
 }
 
-func (c *Conn) IsValid(dial context.Context) bool {
-	select {
-	case <-c.pipeline.Done():
-		return false
-	default:
-		return true
+// WithWarm keeps n children started ahead of Connect, so it needn't wait for
+// one; they're replaced in the background as they're taken
+func WithWarm(n int) Option {
+	return func(c *Connector) {
+		c.warm = n
 	}
 }
 
-func (c *Conn) Ping(ctx context.Context) (err error) {
-	var j job
-	j.ctx, j.cancel = context.WithCancel(ctx)
-	j.ch = make(chan []byte)
+// WithJSON reads the results of every query in .mode json rather than quote
+// mode, as StmtOptions.JSON does for a single statement
+func WithJSON() Option {
+	return func(c *Connector) {
+		c.json = true
+	}
+}
 
-	select {
-	case c.ctl <- j:
-	case <-j.ctx.Done():
-		return j.ctx.Err()
-	case <-c.pipeline.Done():
-		return driver.ErrBadConn
+// WithRawText makes Rows give text as []byte rather than string, as
+// StmtOptions.RawText does for a single statement. The slices are only
+// valid until the next call to Next, and scanning into sql.RawBytes
+// takes them as they are, without a copy; text read in .mode json, and
+// of a row looked at ahead of Next for column types, is still a string
+func WithRawText() Option {
+	return func(c *Connector) {
+		c.rawText = true
 	}
+}
 
-	if locker := c.connector.locker; locker != nil {
-		locker.Lock()
-		defer locker.Unlock()
+// WithSafe runs sqlite3 with -safe, which refuses ATTACH, functions like readfile
+// and dot-commands reaching outside the database; sqlite3 exits on such a
+// statement, which then fails with ErrExited, and the connection is replaced
+func WithSafe() Option {
+	return WithArgs("-safe")
+}
+
+// WithBusyTimeout sets how long a connection retries for while
+// the database is locked, rather than failing straight away, and how long
+// a conn of :memory: waits for another conn's transaction to end, rather
+// than failing with ErrSharedBusy
+func WithBusyTimeout(d time.Duration) Option {
+	return func(c *Connector) {
+		c.pragmas = append(c.pragmas, ".timeout "+strconv.FormatInt(d.Milliseconds(), 10))
+		c.busy = d
 	}
+}
 
-	j.ch <- []byte{}
+// RetryPolicy has a statement run again when it fails because the database
+// is busy or locked. Only a query of one statement outside a transaction is
+// retried, as sqlite3 goes on to the rest of a query after an error, and a
+// transaction may have to be rolled back to get out of the way.
+type RetryPolicy struct {
+	Attempts int           // at most, counting the first, none are retried if less than 2
+	Backoff  time.Duration // before the first retry, doubling after each
+	Max      time.Duration // of the backoff, unlimited if zero
+	Jitter   float64       // fraction of each backoff added or taken at random
+}
 
-	select {
-	case s, ok := <-j.ch:
-		j.cancel()
-		if s := string(s); ok && hasPrefixes(s, "Error", "Runtime error", "Parse error") {
-			return fmt.Errorf("%s", string(s))
+// WithRetry retries statements as p says, on top of any busy timeout
+func WithRetry(p RetryPolicy) Option {
+	return func(c *Connector) {
+		if p.Attempts < 0 || p.Backoff < 0 || p.Max < 0 || p.Jitter < 0 || p.Jitter > 1 {
+			c.invalid(fmt.Errorf("invalid retry policy %+v", p))
+			return
 		}
-		return nil
-	case <-j.ctx.Done():
-		return j.ctx.Err()
-	case <-c.pipeline.Done():
-		return driver.ErrBadConn
+		c.retry = p
 	}
 }
 
-func (c *Conn) Prepare(query string) (driver.Stmt, error) {
-	var quotes, escaped bool
-	visible := -1
-	questions := make([]int, 0, 16)
-	semicolons := make([]int, 0, 16)
-	for i, c := range query {
-		if quotes {
-			switch c {
-			case '\'':
-				if escaped {
-					// no-op
-				} else {
-					escaped = true
-				}
-			default:
-				if escaped {
-					quotes = false
-				}
-			}
-		} else {
-			switch c {
-			case ' ', '\n', '\t', '\f', '\b', '\r':
-			default:
-				visible = i
-			}
-			switch c {
-			case ';':
-				semicolons = append(semicolons, i)
-			case '?':
-				questions = append(questions, i)
-			case '\'':
-				quotes = true
-			default:
-			}
+// WithRestart has a conn whose child exits, as when it's killed for memory,
+// start another and set it up again when next used, rather than fail with
+// driver.ErrBadConn. report, if not nil, is called with the reason the child
+// exited, unless it exited cleanly, as it does after WithIdleTimeout.
+// A transaction open when the child exits is lost, so its conn isn't restarted.
+func WithRestart(report func(error)) Option {
+	return func(c *Connector) {
+		c.restart = true
+		c.report = report
+	}
+}
+
+// Watchdog looks out for a child which prints nothing for Timeout while
+// a query is outstanding. A long query is silent until it's done, too,
+// so Timeout should be longer than any query is expected to take.
+type Watchdog struct {
+	Timeout time.Duration
+	Action  WatchdogAction
+}
+
+type WatchdogAction int
+
+const (
+	WatchdogLog  WatchdogAction = iota // log it, with the log package
+	WatchdogQuit                       // log it & send SIGQUIT, which leaves a core dump to diagnose
+	WatchdogKill                       // log it & kill the child, failing the query with ErrExited
+)
+
+// WithWatchdog watches children as w says, which a hung child
+// would otherwise leave the caller waiting on for good
+func WithWatchdog(w Watchdog) Option {
+	return func(c *Connector) {
+		if w.Timeout < 0 || w.Action < WatchdogLog || w.Action > WatchdogKill {
+			c.invalid(fmt.Errorf("invalid watchdog %+v", w))
+			return
 		}
+		c.watchdog = w
 	}
+}
 
-	if n := len(semicolons); n <= 0 || visible > semicolons[n-1] {
-		query += ";"
-		semicolons = append(semicolons, len(query)-1)
+// WithHistory keeps the last n bytes written to & read from each child,
+// which a ParseError carries, and Conn.History returns
+func WithHistory(n int) Option {
+	return func(c *Connector) {
+		c.history = n
 	}
+}
 
-	return &Stmt{
-		query:      query,
-		conn:       c,
-		semicolons: semicolons,
-		questions:  questions,
-	}, nil
+// WithRedaction has the values of arguments left out of the errors of their
+// queries, out of WithHistory's history and out of WithTrace's output, each
+// given as its parameter in its place, as :id or ?. Numbers & booleans, which
+// can't be told from those of the query itself, are left in the query, and
+// a value quoted in an error sqlite3 prints over two reads may be, too.
+func WithRedaction() Option {
+	return func(c *Connector) {
+		c.redact = true
+	}
 }
 
-func (c *Conn) PrepareContext(_ context.Context, query string) (driver.Stmt, error) {
-	return c.Prepare(query)
+// an error about an argument, whose message has the argument's parameter
+// in place of its value, WithRedaction
+type redacted struct {
+	msg string
+	err error
 }
 
-func (c *Conn) Close() (err error) {
-	c.cancel()
-	close(c.ctl)
-	<-c.Done()
-	for _, err = range c.errs {
-		if err != nil {
-			break
-		}
+func (e *redacted) Error() string {
+	return e.msg
+}
+
+func (e *redacted) Unwrap() error {
+	return e.err
+}
+
+// err about the argument v, of param, without v's value, WithRedaction
+func (c *Connector) scrub(err error, v any, param string) error {
+	if err == nil || !c.redact {
+		return err
 	}
-	return
+	s := fmt.Sprint(v)
+	if s == "" || !strings.Contains(err.Error(), s) {
+		return err
+	}
+	return &redacted{strings.ReplaceAll(err.Error(), s, param), err}
 }
 
-func (c *Conn) Begin() (driver.Tx, error) {
-	s, err := c.Prepare("BEGIN")
-	if err != nil {
-		return nil, err
+// WithTrace writes everything sent to & read from each child to w, a line
+// per write or read, as in: 1234 > "SELECT 1\n;\n". If redact isn't nil,
+// what's written is what it returns for each write or read, which it mustn't
+// modify; reads split output arbitrarily, so a value may not be in one piece.
+func WithTrace(w io.Writer, redact func([]byte) []byte) Option {
+	return func(c *Connector) {
+		c.tracer = &tracer{w: w, redact: redact}
 	}
+}
 
-	_, err = s.Exec(nil)
-	return &Tx{c}, err
+// writes the traffic of all of a connector's children
+type tracer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	redact func([]byte) []byte
 }
 
-func (c *Tx) Rollback() error {
-	s, err := c.Prepare("ROLLBACK")
-	if err != nil {
-		return err
+// a nil tracer writes nothing
+func (t *tracer) trace(c *Conn, dir byte, p []byte) {
+	if t == nil {
+		return
+	}
+	if t.redact != nil {
+		p = t.redact(p)
 	}
 
-	_, err = s.Exec(nil)
-	return err
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(t.w, "%d %c %q\n", c.cmd.Process.Pid, dir, p)
 }
 
-func (c *Tx) Commit() error {
-	s, err := c.Prepare("COMMIT")
-	if err != nil {
-		return err
+// size of the buffer sqlite3's output is read into, unless WithReadBuffer says otherwise
+const DefaultReadSize = 4096
+
+// WithReadBuffer reads each child's output into a buffer of size bytes, which
+// doubles whenever a read fills it, up to max, for rows too wide for a few reads
+func WithReadBuffer(size, max int) Option {
+	return func(c *Connector) {
+		if size < 64 || max < size {
+			c.invalid(fmt.Errorf("invalid read buffer size %d, up to %d", size, max))
+			return
+		}
+		c.readSize, c.readMax = size, max
 	}
+}
 
-	_, err = s.Exec(nil)
-	return err
+// bytes of output read ahead of Rows, unless WithBacklog says otherwise
+const DefaultBacklog = 4 << 20
+
+// WithBacklog limits how much of a query's output is read ahead of Rows to
+// about n bytes, beyond which sqlite3 waits for Rows to catch up; with 0,
+// nothing is read ahead of the chunk Rows is on
+func WithBacklog(n int) Option {
+	return func(c *Connector) {
+		if n < 0 {
+			c.invalid(fmt.Errorf("invalid backlog %d", n))
+			return
+		}
+		c.backlog = n
+	}
 }
 
-func (r *Result) LastInsertId() (int64, error) {
-	return 0, fmt.Errorf("unimplemented")
+// ErrRowTooBig is returned by Rows.Next for a row past WithMaxRowSize
+var ErrRowTooBig = errors.New("sqlite3: row exceeds the size limit")
+
+// WithMaxRowSize fails a query with ErrRowTooBig once a row of its
+// output passes n bytes, rather than holding it in memory; 0 is unlimited
+func WithMaxRowSize(n int) Option {
+	return func(c *Connector) {
+		if n < 0 {
+			c.invalid(fmt.Errorf("invalid row size %d", n))
+			return
+		}
+		c.maxRow = n
+	}
 }
 
-func (r *Result) RowsAffected() (int64, error) {
-	return 0, fmt.Errorf("unimplemented")
+// ErrIntegerOverflow is returned by Rows.Next, WithStrictIntegers,
+// for an integer which doesn't fit in an int64
+var ErrIntegerOverflow = errors.New("sqlite3: integer overflows int64")
+
+// WithStrictIntegers fails a query with ErrIntegerOverflow on an integer
+// past the range of int64, rather than giving it as the nearest float64.
+// sqlite's own integers always fit; such a number comes of a misread.
+func WithStrictIntegers() Option {
+	return func(c *Connector) {
+		c.strictInt = true
+	}
 }
 
-func (r *Rows) Columns() []string {
-	return r.names
+// ErrFloatRange is returned by Rows.Next, WithStrictReals, for a real
+// which is infinite, or too large or small in magnitude for a float64
+var ErrFloatRange = errors.New("sqlite3: real is infinite or out of range")
+
+// WithStrictReals fails a query with ErrFloatRange on an infinite real,
+// which sqlite3 prints as Inf, or as 9.0e+999 in .mode json, rather than
+// giving it as math.Inf
+func WithStrictReals() Option {
+	return func(c *Connector) {
+		c.strictReal = true
+	}
 }
 
-func (r *Rows) Close() error {
-	select {
-	case <-r.ctx.Done():
-	case <-r.conn.Done():
-		for _, err := range r.conn.errs {
-			if err != nil {
-				return err
-			}
-		}
-		return r.conn.Err()
-	default:
-		r.cancel()
+// WithResync has Rows.Next skip a row it can't parse, or which fails as
+// WithMaxRowSize, WithStrictIntegers or WithStrictReals say, and go on to
+// the next, rather than end the query with the row's error, as database/sql
+// gives up on rows at their first; report, if not nil, is called with it.
+// Parser.Next returns the error, and goes on from the next row when called
+// again. Output in .mode json isn't skipped over.
+func WithResync(report func(error)) Option {
+	return func(c *Connector) {
+		c.resync = true
+		c.skipped = report
 	}
-	return nil
 }
 
-func (e *ParseError) Error() string {
-	var c rune = '?'
-	if e.i < len(e.buf) {
-		c = rune(e.buf[e.i])
+// WithParseTime has Rows.Next give text in one of the formats sqlite's date
+// & time functions take, as CURRENT_TIMESTAMP and time.Time arguments are
+// stored, as a time.Time in loc, or UTC if loc is nil; text without a zone is
+// UTC, as sqlite has it. With numeric, an integer is taken as a unix time, and a real
+// as a julian day, in a column declared DATE, DATETIME or TIMESTAMP of a query
+// of the form SELECT columns FROM table. Not with WithRawText, whose text is []byte.
+// time.Time arguments are given in loc, too, as WithLocation has them.
+func WithParseTime(loc *time.Location, numeric bool) Option {
+	return func(c *Connector) {
+		c.parseTime = true
+		c.numericTime = numeric
+		c.loc = loc
 	}
-	return fmt.Sprintf("%s: index %d(char '%c') of %d in: \"%s\"", e.msg, e.i, c, len(e.buf), string(e.buf))
 }
 
-func (r *Rows) Next(dest []driver.Value) (err error) {
-	var i, n, e, d int // i - dest index, n - int value, token index, e - exponent, d - decimal index
-	var b byte
-	var blob []byte
-	var ok bool
-	handle := func(s string) *ParseError {
-		return &ParseError{
-			msg:    s,
-			Parser: r.Parser,
+// layouts of WithTimeFormat giving time.Time arguments as integers: unix
+// times, in seconds or milliseconds, which WithParseTime's numeric takes them as
+const (
+	TimeUnix      = "unix"
+	TimeUnixMilli = "unixmilli"
+)
+
+// WithTimeFormat has time.Time arguments given as text in layout, as
+// time.Time.Format has it, such as time.DateOnly or time.RFC3339, or as
+// integers with TimeUnix or TimeUnixMilli, in place of the default
+// 2006-01-02 15:04:05.999999999-07:00. WithParseTime tries layout first,
+// in the zone of WithLocation if layout has none.
+// The _time_format DSN parameter takes a layout, too, or unix or unixmilli.
+func WithTimeFormat(layout string) Option {
+	return func(c *Connector) {
+		if layout == "" {
+			c.invalid(errors.New("empty time format"))
+			return
 		}
+		c.timeLayout = layout
 	}
+}
 
-	const (
-		NONE int = iota
-		STRING
-		X                       // start of blob literal
-		BLOB                    // sqlite blob literal X'101010' -> \n\n\n ParseInt(s, 16, 8)
-		SIGN                    // +/- preceding a number
-		NUMERIC                 // we see digits, but no decimal - could be int or float
-		DECIMAL                 // we saw the decimal, now expecting digits or e
-		E                       // saw e, now expecting sign
-		EXPONENT                // after value, expecting more digits, white space or ,
-		NULL                    // NULL
-		EOR                     // END OF RECORD
-		PARSE                   // Parse error
-		RUNTIME                 // Runtime error
-		ESCAPED  = 0x10 << iota // white space after a value
-		ERR                     // Error
-	)
+// WithLocation has time.Time arguments given in loc, and WithParseTime's
+// times, rather than in their own zones and in UTC; as the _loc DSN
+// parameter does, with a zone name, or auto or local for time.Local
+func WithLocation(loc *time.Location) Option {
+	return func(c *Connector) {
+		c.loc = loc
+	}
+}
 
-	for r.s != EOR {
-		if r.i >= len(r.buf) {
-			select {
-			case r.buf, ok = <-r.ch:
-				if !ok {
-					return io.EOF
+// WithBooleans has Rows.Next give the integers of a column declared BOOLEAN,
+// and text true or false, as bool, as sqlite stores TRUE & FALSE as 1 & 0,
+// for a query of the form SELECT columns FROM table, whose types are known
+func WithBooleans() Option {
+	return func(c *Connector) {
+		c.bools = true
+	}
+}
+
+// WithColumnTypes has Rows.ColumnTypeDatabaseTypeName, ColumnTypeNullable,
+// ColumnTypeLength & ColumnTypePrecisionScale go by the declared types of the
+// columns of a query of the form SELECT columns FROM table, which takes a query
+// of the table's before each; otherwise, as with other queries, they go by the
+// values of the first row, and nullability, length & precision aren't known.
+// WithParseTime's numeric times, WithBooleans, WithRawJSON & WithTypeDecoder
+// have the types looked up anyway.
+func WithColumnTypes() Option {
+	return func(c *Connector) {
+		c.columnTypes = true
+	}
+}
+
+// WithRawJSON has Rows.Next give the text of a column declared JSON as []byte,
+// for json.Unmarshal, for a query of the form SELECT columns FROM table, whose
+// types are known; StmtOptions.JSONColumns names such columns of any query.
+// Being []byte, not json.RawMessage, it scans into a string, too.
+func WithRawJSON() Option {
+	return func(c *Connector) {
+		c.rawJSON = true
+	}
+}
+
+// Exactness is how WithExactNumbers gives numbers
+type Exactness int
+
+const (
+	// ExactText gives every number as a string, of the digits sqlite3 printed
+	ExactText Exactness = iota + 1
+	// ExactBig gives an integer past int64 as a *big.Int, and a real as a *big.Float
+	ExactBig
+)
+
+// WithExactNumbers has Rows.Next give numbers as e says, rather than
+// give an integer past int64 as the nearest float64, and a real as a
+// float64, which holds what sqlite stores, but not the decimal it was given.
+// WithStrictIntegers has no say then, but WithStrictReals still does.
+// database/sql only scans a *big.Int or *big.Float into an any.
+func WithExactNumbers(e Exactness) Option {
+	return func(c *Connector) {
+		if e != ExactText && e != ExactBig {
+			c.invalid(fmt.Errorf("invalid exactness %d", e))
+			return
+		}
+		c.exact = e
+	}
+}
+
+// Uint64Policy is how a uint64 argument past math.MaxInt64,
+// which sqlite can't store as an integer, is given to it
+type Uint64Policy int
+
+const (
+	// Uint64Fail fails the statement, as for any other type sqlite can't store
+	Uint64Fail Uint64Policy = iota
+	// Uint64Wrap gives the int64 of the same bits, which is negative,
+	// and comes back as the uint64 with StmtOptions.Unsigned
+	Uint64Wrap
+	// Uint64Text gives the digits of it, as text, which a column of
+	// INTEGER, REAL or NUMERIC affinity turns into a real, losing some
+	Uint64Text
+)
+
+// WithUint64 has uint64 & uint arguments past math.MaxInt64 given as p says
+func WithUint64(p Uint64Policy) Option {
+	return func(c *Connector) {
+		if p < Uint64Fail || p > Uint64Text {
+			c.invalid(fmt.Errorf("invalid uint64 policy %d", p))
+			return
+		}
+		c.uint64 = p
+	}
+}
+
+// UTF8Policy is what's done with text which isn't valid UTF-8,
+// of arguments, and of the values Rows.Next gives
+type UTF8Policy int
+
+const (
+	// UTF8Verbatim passes the bytes of it as they are, which sqlite stores
+	// and gives back as it was given
+	UTF8Verbatim UTF8Policy = iota
+	// UTF8Replace replaces each run of bytes which aren't UTF-8 with U+FFFD
+	UTF8Replace
+	// UTF8Fail fails the statement, or the row, with ErrInvalidUTF8
+	UTF8Fail
+)
+
+// ErrInvalidUTF8 is returned, WithUTF8(UTF8Fail), for text which isn't valid
+// UTF-8: by a statement of such an argument, and by Rows.Next of such a value
+var ErrInvalidUTF8 = errors.New("sqlite3: text is not valid UTF-8")
+
+// WithUTF8 has text which isn't valid UTF-8 dealt with as p says, both ways.
+// In .mode json, encoding/json has already replaced it on the way out.
+func WithUTF8(p UTF8Policy) Option {
+	return func(c *Connector) {
+		if p < UTF8Verbatim || p > UTF8Fail {
+			c.invalid(fmt.Errorf("invalid utf-8 policy %d", p))
+			return
+		}
+		c.utf8 = p
+	}
+}
+
+// FloatPolicy is how a NaN or infinite float argument, which strconv would
+// write as text sqlite takes for a name, is given to it
+type FloatPolicy int
+
+const (
+	// FloatSQLite gives an infinity as 9e999, which sqlite takes for one,
+	// and a NaN as NULL, as sqlite stores it
+	FloatSQLite FloatPolicy = iota
+	// FloatNull gives NULL for either
+	FloatNull
+	// FloatText gives the text of it, 'NaN', '+Inf' or '-Inf', which
+	// a column of REAL affinity stores as text, and gives back as it was
+	FloatText
+	// FloatFail fails the statement
+	FloatFail
+)
+
+// WithFloat has NaN & infinite float arguments given as p says
+func WithFloat(p FloatPolicy) Option {
+	return func(c *Connector) {
+		if p < FloatSQLite || p > FloatFail {
+			c.invalid(fmt.Errorf("invalid float policy %d", p))
+			return
+		}
+		c.float = p
+	}
+}
+
+// s, if it isn't valid UTF-8, as p says
+func valid(s string, p UTF8Policy) (string, error) {
+	if p == UTF8Verbatim || utf8.ValidString(s) {
+		return s, nil
+	}
+	if p == UTF8Fail {
+		return "", ErrInvalidUTF8
+	}
+	return strings.ToValidUTF8(s, "\uFFFD"), nil
+}
+
+// Decoder turns a value of a column, as Rows.Next would otherwise give it,
+// into another, as the text of a uuid into a type of uuid. It isn't given NULL.
+type Decoder func(v driver.Value) (driver.Value, error)
+
+// a decoder of the columns declared as decl, or whose names match pattern
+type decoder struct {
+	decl, pattern string
+	decode        Decoder
+}
+
+// whether column i, named name, of r is one of d's
+func (d decoder) matches(r *Rows, i int, name string) bool {
+	if d.pattern != "" {
+		ok, _ := path.Match(strings.ToLower(d.pattern), strings.ToLower(name))
+		return ok
+	}
+	if i >= len(r.columns) || r.columns[i] == nil {
+		return false
+	}
+	decl, _, _ := strings.Cut(r.columns[i].decl, "(")
+	return strings.EqualFold(strings.TrimSpace(decl), d.decl)
+}
+
+// WithTypeDecoder has Rows.Next give the values of columns declared as decl,
+// as in UUID, or VARCHAR of any size, through d, for a query of the form
+// SELECT columns FROM table, whose types are known. Of the decoders matching
+// a column, the first given has its values.
+func WithTypeDecoder(decl string, d Decoder) Option {
+	return func(c *Connector) {
+		c.decoders = append(c.decoders, decoder{decl: decl, decode: d})
+		c.typeDecoders = true
+	}
+}
+
+// WithNameDecoder has Rows.Next give the values of columns whose names
+// match pattern, as path.Match has it, as in ts_*, through d
+func WithNameDecoder(pattern string, d Decoder) Option {
+	return func(c *Connector) {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			c.invalid(fmt.Errorf("invalid column name pattern %q", pattern))
+			return
+		}
+		c.decoders = append(c.decoders, decoder{pattern: pattern, decode: d})
+	}
+}
+
+// Encoder gives the SQL text of an argument of a type it knows, as in
+// X'0a0b' or 'text', and false for the rest
+type Encoder func(v any) (string, bool)
+
+// WithEncoder has e tried on each argument, before the driver's own
+// conversion, which fails for types other than database/sql's and
+// driver.Valuers. Of the encoders given, the first to take it has it.
+// The text goes into the statement as it is, so it must be quoted.
+func WithEncoder(e Encoder) Option {
+	return func(c *Connector) {
+		c.encoders = append(c.encoders, e)
+	}
+}
+
+// the SQL text of v, from the first encoder to take it
+func (c *Connector) encoded(v any) (literal, bool) {
+	if _, ok := v.(literal); ok {
+		return "", false
+	}
+	for _, e := range c.encoders {
+		if s, ok := e(v); ok {
+			return literal(s), true
+		}
+	}
+	return "", false
+}
+
+// the SQL text of an argument, as an encoder gave it
+type literal string
+
+// the values of a slice bound to the parameter of IN (?), each as it's bound
+type list []driver.Value
+
+// how many values a slice bound to IN (?) may have, as many as sqlite
+// takes parameters of a statement
+const maxList = 32766
+
+// v as it's bound: as an encoder gives it, or converted; a pointer is what
+// it points to, or NULL if nil, and a slice other than []byte, or one with
+// a Value method, is each of its values, for IN (?)
+func (c *Connector) bind(v any) (driver.Value, error) {
+	if l, ok := c.encoded(v); ok {
+		return l, nil
+	}
+	if _, ok := v.(driver.Valuer); ok {
+		return convert(v, c.uint64)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return c.bind(rv.Elem().Interface())
+	}
+	if rv.Kind() != reflect.Slice || rv.Type().Elem().Kind() == reflect.Uint8 {
+		return convert(v, c.uint64)
+	}
+
+	if rv.Len() > maxList {
+		return nil, fmt.Errorf("slice of %d values for IN (?), past the limit of %d", rv.Len(), maxList)
+	}
+	l := make(list, rv.Len())
+	for i := range l {
+		v, err := c.bind(rv.Index(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := v.(list); ok {
+			return nil, fmt.Errorf("unsupported type %T, a slice within a slice", rv.Index(i).Interface())
+		}
+		l[i] = v
+	}
+	return l, nil
+}
+
+// WithGracePeriod sets how long Conn.Close waits for a child to exit before
+// sending it SIGTERM, and then SIGKILL
+func WithGracePeriod(d time.Duration) Option {
+	return func(c *Connector) {
+		c.grace = d
+	}
+}
+
+// NewConnector returns a connector to the database at path, which may be
+// anything accepted by sql.Open, configured by opts; use it with sql.OpenDB
+func NewConnector(path string, opts ...Option) (*Connector, error) {
+	return (&Driver{}).connector(path, opts)
+}
+
+func (d *Driver) connector(name string, opts []Option) (*Connector, error) {
+	c := Connector{
+		binary:   "sqlite3",
+		driver:   d,
+		register: make(chan *Conn),
+		suspend:  make(chan struct{}),
+		resume:   make(chan struct{}),
+		quit:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		grace:    DefaultGracePeriod,
+		txlock:   Deferred,
+		readSize: DefaultReadSize,
+		readMax:  DefaultReadSize,
+		backlog:  DefaultBacklog,
+	}
+
+	if err := c.parse(name); err != nil {
+		return nil, err
+	}
+
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	if c.err == nil {
+		c.err = checkArgs(c.args)
+	}
+
+	if c.err == nil {
+		c.err = c.lookPath()
+	}
+
+	if err := c.err; err != nil {
+		if c.temp != "" {
+			os.RemoveAll(c.temp)
+		}
+		return nil, err
+	}
+
+	if c.dir != "" && c.file != "" && !filepath.IsAbs(c.file) {
+		c.file = filepath.Join(c.dir, c.file)
+	}
+
+	// a shared child is started once anyway
+	if c.warm > 0 && c.file != "" {
+		// the refill routine holds one more, waiting to send it
+		c.spares = make(chan *spawned, c.warm-1)
+		c.refilled = make(chan struct{})
+		go c.refill()
+	}
+
+	go c.control()
+	return &c, nil
+}
+
+func (c *Connector) control() {
+	defer close(c.stopped)
+
+	conns := make(map[*Conn]struct{})
+	quit := c.quit
+	var max int
+
+	for {
+		var conn *Conn
+		select {
+		case conn = <-c.register:
+		case <-quit:
+			quit = nil
+			for conn := range conns {
+				conn.cmd.Process.Kill()
+			}
+			if len(conns) == 0 {
+				return
+			}
+			continue
+		}
+
+		if _, ok := conns[conn]; ok {
+			delete(conns, conn)
+			if quit == nil && len(conns) == 0 {
+				return
+			}
+			continue
+		} else {
+			conns[conn] = struct{}{}
+		}
+
+		if quit == nil {
+			// registered while closing
+			conn.cmd.Process.Kill()
+			continue
+		}
+
+		n := len(conns)
+		switch {
+		case max >= 2:
+			// the locker is in place & resume is closed
+		case n == 1:
+			// either the first connection, or the others have all closed
+			c.resume <- struct{}{}
+		case n == 2:
+			// the connector is making a second new connection
+			// the first connection's controller is reading from the suspend channel
+			// when we suspend the first connection, it sets the RWMutex on the driver
+			// and then closes the resume channel
+			var first *Conn
+			for first = range conns {
+				if first != conn {
+					break
+				}
+			}
+			select {
+			case c.suspend <- struct{}{}:
+			case <-first.pipeline.Done():
+				// its controller is gone, and nothing is running on it
+				c.suspend = nil
+				c.locker = &sync.RWMutex{}
+				close(c.resume)
+			}
+		}
+
+		if n > max {
+			max = n
+		}
+	}
+}
+
+// connection settings taken from the underscore-prefixed parameters of a DSN,
+// in the order they're applied; others are left for sqlite3 or ignored
+var settings = []struct {
+	keys   []string
+	pragma string // or dot-command, if it starts with .
+	value  func(string) (string, bool)
+}{
+	// milliseconds to retry for while the database is locked
+	{[]string{"_busy_timeout", "_timeout"}, ".timeout", integer},
+	// on a new database, switching to WAL first would fix auto_vacuum at NONE
+	{[]string{"_auto_vacuum", "_vacuum"}, "auto_vacuum", oneOf("NONE", "FULL", "INCREMENTAL", "0", "1", "2")},
+	{[]string{"_journal_mode", "_journal"}, "journal_mode", oneOf("DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF")},
+	{[]string{"_locking_mode", "_locking"}, "locking_mode", oneOf("NORMAL", "EXCLUSIVE")},
+	{[]string{"_synchronous", "_sync"}, "synchronous", oneOf("OFF", "NORMAL", "FULL", "EXTRA", "0", "1", "2", "3")},
+	{[]string{"_cache_size"}, "cache_size", integer},
+	{[]string{"_foreign_keys", "_fk"}, "foreign_keys", boolean},
+	{[]string{"_defer_foreign_keys", "_defer_fk"}, "defer_foreign_keys", boolean},
+	{[]string{"_recursive_triggers", "_rt"}, "recursive_triggers", boolean},
+	{[]string{"_case_sensitive_like", "_cslike"}, "case_sensitive_like", boolean},
+	{[]string{"_ignore_check_constraints"}, "ignore_check_constraints", boolean},
+	{[]string{"_secure_delete"}, "secure_delete", func(v string) (string, bool) {
+		if strings.EqualFold(v, "FAST") {
+			return "FAST", true
+		}
+		return boolean(v)
+	}},
+	{[]string{"_query_only"}, "query_only", boolean},
+}
+
+func integer(v string) (string, bool) {
+	_, err := strconv.Atoi(v)
+	return v, err == nil
+}
+
+func boolean(v string) (string, bool) {
+	switch strings.ToLower(v) {
+	case "1", "yes", "true", "on":
+		return "ON", true
+	case "0", "no", "false", "off":
+		return "OFF", true
+	default:
+		return "", false
+	}
+}
+
+func oneOf(values ...string) func(string) (string, bool) {
+	return func(v string) (string, bool) {
+		for _, value := range values {
+			if strings.EqualFold(v, value) {
+				return value, true
+			}
+		}
+		return "", false
+	}
+}
+
+// parse a DSN like file:app.db?mode=ro&cache=shared&_busy_timeout=5000 -
+// sqlite3 is given the file, or the URI with its own parameters, which a
+// path with any is made into, while the underscore-prefixed ones become
+// pragmas run on every connection.
+// :temp: is a new file in a temporary directory, removed by Close.
+func (c *Connector) parse(dsn string) error {
+	name, query, _ := strings.Cut(dsn, "?")
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return fmt.Errorf("invalid DSN %q: %w", dsn, err)
+	}
+
+	uri := url.Values{}
+	for k, v := range params {
+		if !strings.HasPrefix(k, "_") {
+			uri[k] = v
+		}
+	}
+
+	for _, s := range settings {
+		for _, k := range s.keys {
+			if !params.Has(k) {
+				continue
+			}
+			v, ok := s.value(params.Get(k))
+			if !ok {
+				return fmt.Errorf("invalid value for %s in DSN: %q", k, params.Get(k))
+			}
+			if strings.HasPrefix(s.pragma, ".") {
+				c.pragmas = append(c.pragmas, s.pragma+" "+v)
+				if s.pragma == ".timeout" {
+					ms, _ := strconv.Atoi(v)
+					c.busy = time.Duration(ms) * time.Millisecond
+				}
+			} else {
+				c.pragmas = append(c.pragmas, "PRAGMA "+s.pragma+" = "+v+";")
+			}
+			break
+		}
+	}
+
+	for _, k := range []string{"_pragma_key", "_key"} {
+		if params.Has(k) {
+			c.key.Store(params.Get(k))
+			break
+		}
+	}
+
+	if params.Has("_parse_time") {
+		switch v := params.Get("_parse_time"); {
+		case strings.EqualFold(v, "numeric"):
+			c.parseTime, c.numericTime = true, true
+		default:
+			on, ok := boolean(v)
+			if !ok {
+				return fmt.Errorf("invalid value for _parse_time in DSN: %q", v)
+			}
+			c.parseTime = on == "ON"
+		}
+	}
+
+	if params.Has("_loc") {
+		switch v := params.Get("_loc"); strings.ToLower(v) {
+		case "auto", "local":
+			c.loc = time.Local
+		default:
+			loc, err := time.LoadLocation(v)
+			if err != nil {
+				return fmt.Errorf("invalid value for _loc in DSN: %q", v)
+			}
+			c.loc = loc
+		}
+	}
+
+	if params.Has("_time_format") {
+		switch v := params.Get("_time_format"); strings.ToLower(v) {
+		case "":
+			return fmt.Errorf("invalid value for _time_format in DSN: %q", v)
+		case TimeUnix, TimeUnixMilli:
+			c.timeLayout = strings.ToLower(v)
+		default:
+			c.timeLayout = v
+		}
+	}
+
+	if params.Has("_txlock") {
+		switch lock := TxLock(strings.ToUpper(params.Get("_txlock"))); lock {
+		case Deferred, Immediate, Exclusive:
+			c.txlock = lock
+		default:
+			return fmt.Errorf("invalid value for _txlock in DSN: %q", params.Get("_txlock"))
+		}
+	}
+
+	if name == ":temp:" {
+		// a fresh database for the connector, removed by Close
+		dir, err := os.MkdirTemp("", "sqlite3-")
+		if err != nil {
+			return err
+		}
+		c.temp = dir
+		name = filepath.Join(dir, "temp.db")
+	}
+
+	// sqlite3 repeats the name in errors, which share its output with results
+	if strings.ContainsAny(name, "\r\n") {
+		return fmt.Errorf("invalid DSN %q: the name of a database can't contain a line break", dsn)
+	}
+
+	if !strings.HasPrefix(name, "file:") && len(uri) == 0 {
+		c.name = name
+		if name != ":memory:" {
+			c.file = name
+		}
+		if strings.HasPrefix(name, "-") {
+			// rather than a flag
+			c.name = "./" + name
+		}
+		return nil
+	}
+
+	if !strings.HasPrefix(name, "file:") {
+		// parameters only mean something to sqlite3 in a URI, which a
+		// path with them is made into
+		name = "file:" + (&url.URL{Path: name}).EscapedPath()
+	}
+
+	c.name = name
+	if len(uri) > 0 {
+		c.name += "?" + uri.Encode()
+	}
+
+	path := strings.TrimPrefix(name, "file:")
+	if rest, ok := strings.CutPrefix(path, "//"); ok {
+		// the authority, if any, can only be localhost
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			path = rest[i:]
+		}
+	}
+	if path, err = url.PathUnescape(path); err != nil {
+		return fmt.Errorf("invalid DSN %q: %w", dsn, err)
+	}
+	if path != ":memory:" && uri.Get("mode") != "memory" {
+		c.file = path
+	}
+	return nil
+}
+
+// Close terminates every child process and stops the connector
+func (c *Connector) Close() error {
+	c.once.Do(func() {
+		close(c.quit)
+	})
+	<-c.stopped
+	if c.refilled != nil {
+		<-c.refilled
+	}
+
+	if c.temp != "" {
+		return os.RemoveAll(c.temp)
+	}
+	return nil
+}
+
+func makePipes(p []*os.File) (err error) {
+	if len(p)%2 != 0 {
+		return fmt.Errorf("pipe array must be divisible by 2")
+	}
+
+	var i int
+	for i = 0; i+1 < len(p) && err == nil; i += 2 {
+		p[i], p[i+1], err = os.Pipe()
+	}
+
+	if err == nil {
+		return
+	}
+
+	for i -= 3; i > 0; i-- {
+		p[i].Close()
+	}
+
+	return
+}
+
+type ReadCloser struct {
+	bufio.Reader
+	f *os.File
+}
+
+func (r *ReadCloser) Close() error {
+	return r.f.Close()
+}
+
+func (c *Connector) Connect(dial context.Context) (driver.Conn, error) {
+	var err error
+
+	select {
+	case <-c.quit:
+		return nil, fmt.Errorf("connector is closed")
+	case <-dial.Done():
+		return nil, dial.Err()
+	default:
+	}
+
+	if c.file == "" {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if owner := c.shared; owner != nil && owner.pipeline.Err() == nil {
+			owner.sharers++
+			return &Conn{
+				connector: c,
+				driver:    c.driver,
+				cmd:       owner.cmd,
+				ctl:       owner.ctl,
+				Context:   owner.Context,
+				pipeline:  owner.pipeline,
+				cancel:    owner.cancel,
+				owner:     owner,
+				lease:     owner.lease,
+			}, nil
+		}
+	}
+
+	conn, err := c.start(dial)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.file == "" {
+		conn.lease = make(chan struct{}, 1)
+		c.shared = conn
+	}
+
+	return conn, nil
+}
+
+// start a child, with the routines around it, and set it up
+func (c *Connector) start(dial context.Context) (*Conn, error) {
+	err := c.take(dial)
+	if err != nil {
+		return nil, err
+	}
+
+	var child *spawned
+	select {
+	case child = <-c.spares:
+	default:
+		if child, err = c.spawn(); err != nil {
+			c.give()
+			return nil, err
+		}
+	}
+	cmd, stdin, outerr := child.cmd, child.stdin, child.outerr
+
+	ctx, mark := context.WithCancel(context.Background())
+
+	// this is the context strictly for the stdin -> sqlite -> stdout pipeline
+	pipeline, cancel := context.WithCancel(context.Background())
+
+	conn := Conn{
+		connector: c,
+		driver:    c.driver,
+		cmd:       cmd,
+		ctl:       make(chan job),
+		Context:   ctx,
+		pipeline:  pipeline,
+		cancel:    cancel,
+		sharers:   1,
+	}
+	conn.owner = &conn
+	conn.tail = newRing(exitTail)
+
+	if c.history > 0 {
+		conn.sent, conn.received = newRing(c.history), newRing(c.history)
+	}
+
+	// a quote inside of a line, not doubled or next to a comma, can't be part of a
+	// value, and the random part keeps anything else, like errors, from forging it
+	var nonce [8]byte
+	rand.Read(nonce[:])
+	conn.cookie = fmt.Sprintf("-'%x'-", nonce)
+
+	r := make(chan job)
+
+	// undo the spawn of a child that was never registered
+	abort := func(err error) (*Conn, error) {
+		child.kill()
+		c.give()
+		cancel()
+		mark()
+		return nil, err
+	}
+
+	select {
+	case c.register <- &conn:
+	case <-c.stopped:
+		return abort(fmt.Errorf("connector is closed"))
+	case <-dial.Done():
+		return abort(dial.Err())
+	}
+
+	wg := &sync.WaitGroup{}
+
+	wg.Add(1)
+	go func() {
+		conn.fail(2, conn.read(outerr, r))
+		cancel()
+		outerr.Close()
+		wg.Done()
+	}()
+
+	wg.Add(1)
+	go func() {
+		<-c.resume
+		conn.fail(1, conn.control(pipeline, stdin, r))
+		cancel()
+		stdin.Close()
+		wg.Done()
+	}()
+
+	go func() {
+		err := cmd.Wait()
+		cancel()
+		wg.Wait()
+		// once the reader has the last of the output
+		conn.fail(0, conn.exited(err))
+		c.give()
+		c.register <- &conn // unregister
+		mark()
+	}()
+
+	if err = conn.setup(dial); err == nil {
+		err = dial.Err()
+	}
+
+	if err != nil {
+		// the routines above unregister the conn once the child is gone
+		cmd.Process.Kill()
+		cancel()
+		if errors.Is(err, ErrExited) {
+			<-conn.Done()
+			if conn.errs[0] != nil {
+				err = fmt.Errorf("%w: %w", err, conn.errs[0])
+			}
+		}
+		return nil, err
+	}
+
+	return &conn, nil
+}
+
+// the error of cmd.Wait, as a ProcessExitError if the child exited uncleanly
+func (c *Conn) exited(err error) error {
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) {
+		return err
+	}
+
+	e := &ProcessExitError{Code: exit.ExitCode(), Err: err}
+	if status, ok := exit.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		e.Signal = status.Signal()
+	}
+
+	// what came after the last query to finish is what it said on the way out
+	out := string(c.tail.Bytes())
+	if i := strings.LastIndex(out, c.cookie); i >= 0 {
+		_, out, _ = strings.Cut(out[i:], "\n")
+	}
+	e.Output = strings.TrimSpace(out)
+	return e
+}
+
+// whether a child which has exited is replaced: WithRestart, or once
+// WithIdleTimeout ended it. that's not done within a transaction, which went
+// with the child, nor to a shared child, whose in-memory database went with it
+func (c *Conn) respawns() bool {
+	return (c.connector.restart || c.owner.reaped.Load()) && c.tx == nil && c.lease == nil
+}
+
+// replace a child which has exited with a new one, if it respawns
+func (c *Conn) restart(ctx context.Context) error {
+	if c.pipeline.Err() == nil || !c.respawns() {
+		return nil
+	}
+
+	// the routines are done with the child once the conn is
+	<-c.owner.Done()
+	var exited error
+	for _, err := range c.owner.errs {
+		if err != nil {
+			exited = err
+			break
+		}
+	}
+
+	fresh, err := c.connector.start(ctx)
+	if err != nil {
+		return err
+	}
+
+	// the conn carries on as if fresh were a conn sharing its child
+	c.cmd, c.ctl, c.pipeline, c.cancel, c.Context = fresh.cmd, fresh.ctl, fresh.pipeline, fresh.cancel, fresh.Context
+	c.owner = fresh
+	c.busy, c.reset = nil, nil
+
+	if exited != nil && c.connector.report != nil {
+		c.connector.report(exited)
+	}
+	return nil
+}
+
+// run the connector's pragmas & init scripts on a new connection
+func (c *Conn) setup(ctx context.Context) error {
+	pragmas := c.connector.pragmas
+	if len(c.connector.args) > 0 {
+		// whatever the likes of -cmd printed comes before the first cookie
+		pragmas = append([]string{""}, pragmas...)
+	}
+
+	if key, _ := c.connector.key.Load().(string); key != "" {
+		// the key is only checked once something is read
+		if err := c.keyed(ctx, "key", key); err != nil {
+			return err
+		}
+		if _, err := c.exec(ctx, "SELECT count(*) FROM sqlite_master;"); err != nil {
+			return fmt.Errorf("wrong key, or not an encrypted database: %w", err)
+		}
+	}
+
+	for _, query := range pragmas {
+		if _, err := c.exec(ctx, query); err != nil {
+			if query != "" {
+				err = fmt.Errorf("%s: %w", query, err)
+			}
+			return err
+		}
+	}
+
+	// a script stops at its first failing statement
+	for _, script := range c.connector.init {
+		s := c.prepare(script)
+		s.opts.BailOn = true
+		if _, err := s.exec(ctx, s.query); err != nil {
+			return fmt.Errorf("init script: %w", err)
+		}
+	}
+	return nil
+}
+
+// ErrTooManyConns is returned by Connect when WithMaxConns' limit is reached
+var ErrTooManyConns = errors.New("sqlite3: too many connections")
+
+// take one of the slots of WithMaxConns, if limited
+func (c *Connector) take(dial context.Context) error {
+	if c.slots == nil {
+		return nil
+	}
+
+	select {
+	case c.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if c.wait == 0 {
+		return ErrTooManyConns
+	} else if c.wait > 0 {
+		t := time.NewTimer(c.wait)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case c.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return ErrTooManyConns
+	case <-dial.Done():
+		return dial.Err()
+	case <-c.quit:
+		return fmt.Errorf("connector is closed")
+	}
+}
+
+// give back a slot taken once a child is gone
+func (c *Connector) give() {
+	if c.slots != nil {
+		<-c.slots
+	}
+}
+
+// ErrBinaryNotFound is wrapped by the error of a connector
+// whose sqlite3 binary can't be found
+var ErrBinaryNotFound = errors.New("sqlite3 binary not found")
+
+// check the binary exists, before Connect fails to run it
+func (c *Connector) lookPath() error {
+	path := c.binary
+	if strings.ContainsRune(path, filepath.Separator) {
+		if c.dir != "" && !filepath.IsAbs(path) {
+			path = filepath.Join(c.dir, path)
+		}
+		if _, err := exec.LookPath(path); err != nil {
+			return fmt.Errorf("%w: %s isn't an executable file; give the path of sqlite3 with WithBinary", ErrBinaryNotFound, path)
+		}
+		return nil
+	}
+
+	if _, err := exec.LookPath(path); err != nil {
+		return fmt.Errorf("%w: %s isn't in $PATH (%s); install it, or give its path with WithBinary", ErrBinaryNotFound, path, os.Getenv("PATH"))
+	}
+	return nil
+}
+
+// a child started, maybe ahead of Connect
+type spawned struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	outerr io.ReadCloser
+}
+
+func (c *Connector) spawn() (*spawned, error) {
+	var pipes [4]*os.File
+
+	args := append([]string{"-quote", "-header"}, c.args...)
+	cmd := exec.Command(c.binary, append(args, c.name)...)
+	cmd.Dir = c.dir
+	if len(c.env) > 0 {
+		cmd.Env = append(os.Environ(), c.env...)
+	}
+
+	if err := makePipes(pipes[:]); err != nil {
+		return nil, err
+	}
+
+	cmd.Stdin = pipes[0]
+	cmd.Stdout = pipes[3]
+	cmd.Stderr = pipes[3]
+
+	if err := cmd.Start(); err != nil {
+		for _, f := range pipes {
+			f.Close()
+		}
+		return nil, err
+	}
+	pipes[0].Close()
+	pipes[3].Close()
+
+	return &spawned{cmd: cmd, stdin: pipes[1], outerr: pipes[2]}, nil
+}
+
+func (s *spawned) kill() {
+	s.cmd.Process.Kill()
+	s.stdin.Close()
+	s.outerr.Close()
+	s.cmd.Wait()
+}
+
+// keep the spares channel full of children for Connect to take,
+// until the connector is closed
+func (c *Connector) refill() {
+	defer close(c.refilled)
+
+	for {
+		child, err := c.spawn()
+		if err != nil {
+			// Connect reports it when it spawns its own
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-c.quit:
+			}
+		} else {
+			select {
+			case c.spares <- child:
+				continue
+			case <-c.quit:
+				child.kill()
+			}
+		}
+
+		for {
+			select {
+			case child := <-c.spares:
+				child.kill()
+			default:
+				return
+			}
+		}
+	}
+}
+
+func (c *Connector) Driver() driver.Driver {
+	return c.driver
+
+}
+
+// control routine, which writes each job's query to stdin
+// and then passes the job on to the reader
+func (c *Conn) control(ctx context.Context, stdin io.Writer, r chan job) error {
+	defer close(r)
+
+	t := "\n.print \"" + c.cookie + "\"\n"
+	var buf []byte
+
+	var job job
+	var ok bool
+
+	// with an idle timeout, the child exits once it's been idle that long,
+	// outside of a transaction, and is respawned when next used - but not
+	// a shared child
+	var last <-chan struct{} // done channel of the last job
+	var idle *time.Timer
+	var expired <-chan time.Time
+	reap := c.connector.idle > 0 && c.connector.file != ""
+	if reap {
+		idle = time.NewTimer(c.connector.idle)
+		expired = idle.C
+	}
+
+	for {
+		select {
+		case job, ok = <-c.ctl:
+			if !ok {
+				return nil
+			}
+			if idle != nil {
+				idle.Stop()
+				expired = nil
+			}
+			last = job.done
+		case <-last:
+			last = nil
+			if reap {
+				idle = time.NewTimer(c.connector.idle)
+				expired = idle.C
+			}
+			continue
+		case <-expired:
+			if c.held.Load() {
+				idle.Reset(c.connector.idle)
+				continue
+			}
+			c.reaped.Store(true)
+			return nil
+		case <-c.connector.suspend:
+			c.connector.suspend = nil
+			if ok { // job is valid
+				<-job.ctx.Done()
+				// last job is finished
+			}
+			c.connector.locker = &sync.RWMutex{}
+			close(c.connector.resume)
+			continue
+		case <-ctx.Done():
+			return nil
+		}
+
+		// the job's holder sends the query regardless, nil if it gave up
+		cmd := <-job.in
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		n := len(t) + len(cmd)
+		if len(buf) < n {
+			buf = make([]byte, n)
+			copy(buf[len(cmd):], t) // copy trailer to end of buffer
+		}
+
+		b := buf[len(buf)-n:]
+		copy(b, cmd)
+
+		// the reader has the job before it's written, as sqlite3 may answer
+		// the first statements of a long script before it reads the rest,
+		// and would block on a full pipe, reading no more, if no one took it
+		select {
+		case r <- job:
+		case <-ctx.Done():
+			return nil
+		}
+
+		sent := b
+		if job.redact != nil {
+			sent = []byte(job.redact.Replace(string(b)))
+		}
+		c.sent.Write(sent)
+		c.connector.tracer.trace(c, '>', sent)
+		if _, err := stdin.Write(b); err != nil {
+			return err
+		}
+	}
+}
+
+// reader routine
+func (c *Conn) read(r io.Reader, ch <-chan job) error {
+	var i, j, n int // i - bytes of buf done with, j - bytes of buf read into
+	var err error
+
+	var size int = c.connector.readSize
+	var refill int = int(math.Ceil(float64(size) / 4 * 3))
+	var buf []byte = make([]byte, size)
+
+	cookie := []byte(c.cookie)
+	var bol = true // buf starts a line
+	var stale bool // buf has been searched since the last read
+	var job job
+	var ok bool
+
+	if size < len(cookie)+3 { // cookie is preceded by a newline, and followed by \r\n at most
+		return fmt.Errorf("read buffer of %d bytes is too small for the cookie", size)
+	}
+
+	for {
+		if !ok {
+			job, ok = <-ch
+		}
+
+		// if the buffer is 3/4ths its original capacity
+		if len(buf) < refill {
+			tmp := make([]byte, size)
+			copy(tmp, buf[:j])
+			buf = tmp
+		}
+
+		if j > 0 && ok && !stale {
+			// still got bytes left to process
+		} else if n, err = r.Read(buf[j:]); err == io.EOF {
+			if j > 0 {
+				s := strings.TrimSpace(string(buf[:j]))
+				return newError(s, "", 0)
+			}
+			return nil
+		} else if err != nil {
+			return err
+		} else {
+			c.heard.Store(time.Now().UnixNano())
+			// sqlite3 quotes the statement an error is in, arguments and all
+			got := buf[j : j+n]
+			if ok && job.redact != nil {
+				got = []byte(job.redact.Replace(string(got)))
+			}
+			c.received.Write(got)
+			c.tail.Write(got)
+			c.connector.tracer.trace(c, '<', got)
+			j += n
+			stale = false
+
+			// the read filled the buffer, so there's likely more waiting
+			if j == len(buf) && size < c.connector.readMax {
+				size = min(size*2, c.connector.readMax)
+				refill = int(math.Ceil(float64(size) / 4 * 3))
+			}
+		}
+
+		if !ok {
+			continue
+		}
+
+		// the cookie is a line of its own; what may be the start of it is
+		// held back until the rest is read, the job's output is what's before
+		end, found, m := j, false, 0 // m - length of the cookie's line
+		for p := 0; p < j; {
+			if p > 0 || bol {
+				if m = cookieLine(buf[p:j], cookie); m > 0 {
+					end, found = p, true
+					break
+				} else if m < 0 {
+					end = p
+					break
+				}
+			}
+
+			k := bytes.IndexByte(buf[p:j], '\n')
+			if k < 0 {
+				break
+			}
+			p += k + 1
+		}
+
+		if end > 0 {
+			select {
+			case job.ch <- buf[:end]:
+			case <-job.ctx.Done():
+			}
+		}
+
+		i = end
+		if found {
+			close(job.ch)
+			if job.done != nil {
+				close(job.done)
+			}
+			ok = false
+			i += m
+		}
+		// what's left after a cookie is the next job's, and hasn't been searched
+		stale = !found
+
+		if i > 0 {
+			bol = buf[i-1] == '\n'
+		}
+		buf = buf[i:]
+		j -= i
+		i = 0
+	}
+}
+
+// the length of the cookie's line at the start of b, with its \n or \r\n,
+// 0 if b doesn't start with it, or -1 if it may once more is read
+func cookieLine(b, cookie []byte) int {
+	if len(b) < len(cookie) {
+		if bytes.HasPrefix(cookie, b) {
+			return -1
+		}
+		return 0
+	}
+	if !bytes.HasPrefix(b, cookie) {
+		return 0
+	}
+
+	switch rest := b[len(cookie):]; {
+	case len(rest) == 0, len(rest) == 1 && rest[0] == '\r':
+		return -1
+	case rest[0] == '\n':
+		return len(cookie) + 1
+	case rest[0] == '\r' && rest[1] == '\n':
+		return len(cookie) + 2
+	}
+	return 0
+}
+
+func (c *Conn) ResetSession(ctx context.Context) error {
+	if c.killed.Load() {
+		return driver.ErrBadConn
+	}
+	if err := c.restart(ctx); err != nil {
+		return driver.ErrBadConn
+	}
+
+	select {
+	case <-c.pipeline.Done():
+		return driver.ErrBadConn
+	default:
+	}
+
+	// wait out whatever is left of the last job's output
+	if c.busy != nil {
+		select {
+		case <-c.busy:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.pipeline.Done():
+			return driver.ErrBadConn
+		}
+	}
+
+	// a transaction left open by the last user of the connection
+	if c.tx != nil {
+		outer := c.tx
+		for outer.parent != nil {
+			outer = outer.parent
+		}
+		if err := outer.Rollback(); err != nil {
+			return driver.ErrBadConn
+		}
+	}
+
+	// or by a BEGIN of its own, which the driver doesn't know of; not on a
+	// shared child, where it might be another conn's
+	if c.begun && c.tx == nil && c.lease == nil {
+		if _, err := c.exec(ctx, "ROLLBACK;"); err != nil && !strings.Contains(err.Error(), "no transaction is active") {
+			return driver.ErrBadConn
+		}
+	}
+	c.begun = false
+
+	for len(c.reset) > 0 {
+		query := c.reset[0]
+		c.reset = c.reset[1:]
+		if _, err := c.exec(ctx, query); err != nil {
+			return driver.ErrBadConn
+		}
+	}
+
+	return nil
+}
+
+// whether query may begin a transaction, with BEGIN or SAVEPOINT
+func begins(query string) bool {
+	for i := 0; i < len(query); i++ {
+		switch query[i] | 0x20 {
+		case 'b':
+			if i+5 <= len(query) && strings.EqualFold(query[i:i+5], "BEGIN") {
+				return true
+			}
+		case 's':
+			if i+9 <= len(query) && strings.EqualFold(query[i:i+9], "SAVEPOINT") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *Conn) IsValid(dial context.Context) bool {
+	if c.killed.Load() {
+		return false
+	}
+	select {
+	case <-c.pipeline.Done():
+		// ResetSession restarts it
+		return c.respawns()
+	default:
+		return true
+	}
+}
+
+// set one of errs, which Diagnostics may be reading in the meantime
+func (c *Conn) fail(i int, err error) {
+	c.errsMu.Lock()
+	c.errs[i] = err
+	c.errsMu.Unlock()
+}
+
+// Diagnostics is what's become of a conn's child and the routines around it
+type Diagnostics struct {
+	Pid     int
+	Running bool      // the child and the routines haven't stopped
+	Exited  error     // how the child exited, a *ProcessExitError unless cleanly
+	Control error     // of writing queries to the child
+	Reader  error     // of reading the child's output
+	Busy    bool      // the last query's output hasn't all been read
+	InTx    bool      // a transaction is open
+	Shared  bool      // other conns share the child, as with :memory:
+	Heard   time.Time // when the child last printed anything, zero if never
+}
+
+// Diagnostics reports on the conn's child, as of now; it's reachable
+// through sql.Conn.Raw. Restarting WithRestart starts over with another child.
+func (c *Conn) Diagnostics() Diagnostics {
+	owner := c.owner
+	d := Diagnostics{
+		Pid:     owner.cmd.Process.Pid,
+		Running: owner.Err() == nil,
+		InTx:    c.tx != nil,
+		Shared:  c.lease != nil,
+	}
+
+	owner.errsMu.Lock()
+	d.Exited, d.Control, d.Reader = owner.errs[0], owner.errs[1], owner.errs[2]
+	owner.errsMu.Unlock()
+
+	if c.busy != nil {
+		select {
+		case <-c.busy:
+		default:
+			d.Busy = true
+		}
+	}
+	if n := owner.heard.Load(); n != 0 {
+		d.Heard = time.Unix(0, n)
+	}
+	return d
+}
+
+// History returns the last of what was written to & read from the child,
+// nil unless the connector was made WithHistory
+func (c *Conn) History() (sent, received []byte) {
+	return c.owner.sent.Bytes(), c.owner.received.Bytes()
+}
+
+// the last bytes written to it
+type ring struct {
+	mu   sync.Mutex
+	buf  []byte
+	next int  // index of buf the next byte goes to
+	full bool // buf has wrapped around
+}
+
+func newRing(n int) *ring {
+	return &ring{buf: make([]byte, n)}
+}
+
+// a nil ring keeps nothing
+func (r *ring) Write(p []byte) (int, error) {
+	if r == nil {
+		return len(p), nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := len(p)
+	if len(p) > len(r.buf) {
+		p = p[len(p)-len(r.buf):]
+	}
+	m := copy(r.buf[r.next:], p)
+	copy(r.buf, p[m:])
+	if r.next+len(p) >= len(r.buf) {
+		r.full = true
+	}
+	r.next = (r.next + len(p)) % len(r.buf)
+	return n, nil
+}
+
+func (r *ring) Bytes() []byte {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]byte(nil), r.buf[:r.next]...)
+	}
+	return append(append([]byte(nil), r.buf[r.next:]...), r.buf[:r.next]...)
+}
+
+func (c *Conn) Ping(ctx context.Context) error {
+	// unlike SELECT 1, reading the schema touches the file,
+	// so it fails if the database is locked or corrupt
+	rows, err := c.query(ctx, "SELECT count(*) FROM sqlite_master;")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if err := rows.Next(make([]driver.Value, 1)); err != nil {
+		return err
+	}
+
+	return c.stat()
+}
+
+// check the database file is still the one the child opened
+func (c *Conn) stat() error {
+	path := c.connector.file
+	if path == "" {
+		return nil
+	}
+
+	fi, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err) && c.file == nil:
+		// not created until the first write
+		return nil
+	case os.IsNotExist(err):
+		return fmt.Errorf("database file %s was removed: %w", path, driver.ErrBadConn)
+	case err != nil:
+		return err
+	case c.file == nil:
+		c.file = fi
+		return nil
+	case !os.SameFile(c.file, fi):
+		return fmt.Errorf("database file %s was replaced: %w", path, driver.ErrBadConn)
+	default:
+		return nil
+	}
+}
+
+func (c *Conn) Prepare(query string) (driver.Stmt, error) {
+	s := c.prepare(query)
+	if s.syntax != nil {
+		return nil, s.syntax
+	}
+	return s, nil
+}
+
+func (c *Conn) prepare(query string) *Stmt {
+	var returning bool
+	var quote rune // closing the string or quoted identifier being read, if any
+	quote0 := -1   // where it opened
+	closed := -1   // where the last one closed
+	var body body
+	var comment byte // '-' within a -- comment, '*' within a /* one
+	visible := -1
+	word := -1     // start of the current bare word
+	param0 := -1   // start of the current ?NNN or named parameter
+	comment0 := -1 // start of the current comment
+	stmt, begun := 0, false
+	b := scratches.Get().(*scratch)
+	params, semicolons := b.params, b.semicolons
+
+	end := func(i int) {
+		p := param{i: param0, n: i - param0, stmt: stmt}
+		if query[param0] != '?' {
+			p.name = query[param0:i]
+		} else if p.n > 1 {
+			p.index, _ = strconv.Atoi(query[param0+1 : i])
+		}
+		// a lone :, @ or $ is not a parameter
+		if p.n > 1 || p.name == "" {
+			params = append(params, p)
+		}
+		param0 = -1
+	}
+
+	for i, c := range query {
+		switch {
+		case comment == '-':
+			if c == '\n' {
+				comment = 0
+			}
+			continue
+		case comment == '*':
+			// not the * of the /* itself
+			if c == '/' && i >= comment0+3 && query[i-1] == '*' {
+				comment = 0
+			}
+			continue
+		}
+		if quote != 0 {
+			// an escaped quote just re-opens the string
+			if c == quote {
+				quote, closed = 0, i
+			}
+			continue
+		}
+
+		digit := c >= '0' && c <= '9'
+		ident := c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+
+		if param0 >= 0 && (!ident || query[param0] == '?' && !digit) {
+			end(i)
+		}
+
+		switch {
+		case ident:
+			if word < 0 {
+				word = i
+			}
+		case word >= 0:
+			returning = returning || strings.EqualFold(query[word:i], "RETURNING")
+			body.word(query[word:i])
+			word = -1
+		}
+
+		if c == '-' && strings.HasPrefix(query[i:], "--") || c == '/' && strings.HasPrefix(query[i:], "/*") {
+			comment, comment0 = query[i+1], i
+			continue
+		}
+
+		switch c {
+		case ' ', '\n', '\t', '\f', '\b', '\r':
+		default:
+			visible = i
+			begun = begun || c != ';'
+		}
+
+		switch c {
+		case ';':
+			if body.end() {
+				semicolons = append(semicolons, i)
+				if begun {
+					stmt++
+				}
+				begun = false
+			}
+		case '?', ':', '@', '$':
+			param0 = i
+		case '\'', '"', '`':
+			if closed < 0 || i != closed+1 || query[closed] != byte(c) {
+				quote0 = i
+			}
+			quote = c
+		case '[':
+			quote, quote0 = ']', i
+		default:
+		}
+	}
+
+	if param0 >= 0 {
+		end(len(query))
+	}
+
+	if word >= 0 {
+		returning = returning || strings.EqualFold(query[word:], "RETURNING")
+	}
+
+	// an unterminated quote is an error, as sqlite reports it, where sqlite3
+	// would wait for the rest of it
+	var err error
+	if quote != 0 {
+		e := newError(fmt.Sprintf("Parse error near line 1: unrecognized token: \"%s\"", query[quote0:]), "", 0)
+		e.Statement = stmt
+		e.locate(query, 0)
+		e.Query = strings.TrimSpace(query[e.Offset:])
+		err = e
+	}
+
+	// sqlite ends an unterminated /* comment with the query, where sqlite3
+	// would wait for the rest of it
+	if comment == '*' {
+		query += "*/"
+	}
+	if n := len(semicolons); n <= 0 || visible > semicolons[n-1] {
+		if comment == '-' {
+			query += "\n" // or the ; would be part of the comment
+		}
+		query += ";"
+		semicolons = append(semicolons, len(query)-1)
+	}
+
+	// number the parameters the way sqlite does: ?NNN is explicit,
+	// while ? and new names take the next index after the largest so far
+	indexes := make(map[string]int)
+	inputs := 0
+	for i, p := range params {
+		switch index, ok := indexes[p.name]; {
+		case p.index > 0:
+		case p.name == "":
+			p.index = inputs + 1
+		case ok:
+			p.index = index
+		default:
+			p.index = inputs + 1
+			indexes[p.name] = p.index
+		}
+		params[i] = p
+		inputs = max(inputs, p.index)
+	}
+
+	return &Stmt{
+		query:      query,
+		conn:       c,
+		semicolons: semicolons,
+		params:     params,
+		inputs:     inputs,
+		returning:  returning,
+		syntax:     err,
+	}
+}
+
+func (c *Conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.pipeline.Done():
+		return nil, driver.ErrBadConn
+	default:
+	}
+
+	s := c.prepare(query)
+	if s.syntax != nil {
+		return nil, s.syntax
+	}
+	if opts, ok := ctx.Value(stmtOptionsKey{}).(StmtOptions); ok {
+		s.opts = opts
+	}
+	return s, nil
+}
+
+func (c *Conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	opts, _ := ctx.Value(stmtOptionsKey{}).(StmtOptions)
+
+	// without anything to substitute or split, the query goes as prepare ends it,
+	// closing a comment & refusing an open quote; the rest of opts are of reading rows
+	if len(args) == 0 && opts.Timeout == 0 && !opts.Bail && !opts.BailOn && !containsFold(query, "RETURNING") {
+		s := c.prepare(query)
+		defer s.Close()
+		if s.syntax != nil {
+			return nil, s.syntax
+		}
+		ctx = from(ctx, query, 0)
+		c.redactor = nil
+		return retry(c, ctx, s.query, func() (*Result, error) {
+			return c.exec(ctx, s.query)
+		})
+	}
+
+	s := c.prepare(query)
+	s.opts = opts
+
+	query, err := subst2(s, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.exec(ctx, query)
+}
+
+func (c *Conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	// scanned even with nothing to substitute, to close a comment & refuse an open quote
+	s := c.prepare(query)
+	s.opts, _ = ctx.Value(stmtOptionsKey{}).(StmtOptions)
+
+	query, err := subst2(s, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.queryRows(ctx, query)
+}
+
+func (c *Conn) Close() error {
+	if c.lease != nil {
+		c.connector.mu.Lock()
+		c.owner.sharers--
+		last := c.owner.sharers == 0
+		c.connector.mu.Unlock()
+
+		if !last {
+			// the child lives on for the other conns
+			if c.tx != nil {
+				outer := c.tx
+				for outer.parent != nil {
+					outer = outer.parent
+				}
+				outer.Rollback()
+			}
+			c.release(nil)
+			return nil
+		}
+	}
+	err := c.owner.shutdown()
+	if c.opened {
+		c.connector.Close()
+	}
+	return err
+}
+
+// stop the child & the routines around it
+func (c *Conn) shutdown() (err error) {
+	c.cancel()
+	close(c.ctl)
+
+	// closing stdin should be enough, but a busy child may need a signal or two
+	var sent string
+	for _, sig := range []struct {
+		name   string
+		signal os.Signal
+	}{{"SIGTERM", syscall.SIGTERM}, {"SIGKILL", os.Kill}} {
+		if c.wait(c.connector.grace) {
+			break
+		}
+		c.cmd.Process.Signal(sig.signal)
+		sent = sig.name
+	}
+	<-c.Done()
+
+	for _, err = range c.errs {
+		if err != nil {
+			break
+		}
+	}
+
+	if sent != "" && err != nil {
+		err = fmt.Errorf("sqlite3 didn't exit within %s of its input closing, so it was sent %s: %w", c.connector.grace, sent, err)
+	}
+	return
+}
+
+// whether the connection's routines finish within d
+func (c *Conn) wait(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-c.Done():
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// a shared child is leased for each statement, and for the whole of a transaction
+
+// take the shared child, if any, waiting for the other conns to be done with it
+func (c *Conn) acquire(ctx context.Context) error {
+	if c.lease == nil {
+		return nil
+	}
+	if c.leases > 0 {
+		c.leases++
+		return nil
+	}
+
+	select {
+	case c.lease <- struct{}{}:
+		c.leases++
+		return nil
+	default:
+	}
+
+	// another conn's transaction has the child until it ends, which is waited
+	// for no longer than the busy timeout, as a locked database would be;
+	// from the goroutine with the transaction, it would never end
+	var expired <-chan time.Time
+	if c.owner.held.Load() {
+		t := time.NewTimer(c.connector.busy)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	select {
+	case c.lease <- struct{}{}:
+	case <-expired:
+		return ErrSharedBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.pipeline.Done():
+		return driver.ErrBadConn
+	}
+	c.leases++
+	return nil
+}
+
+// ErrSharedBusy is returned for a statement of a conn of :memory: while
+// another conn has a transaction open, once it's waited WithBusyTimeout
+var ErrSharedBusy = errors.New("sqlite3: the in-memory database is in another conn's transaction")
+
+// give back the shared child once done is closed, or straight away if nil
+func (c *Conn) release(done <-chan struct{}) {
+	if c.leases == 0 {
+		return
+	}
+	if c.leases--; c.leases > 0 {
+		return
+	}
+	if done == nil {
+		<-c.lease
+		return
+	}
+	go func() {
+		select {
+		case <-done:
+		case <-c.pipeline.Done():
+		}
+		<-c.lease
+	}()
+}
+
+// Rekey changes the key of an encrypted database, like PRAGMA rekey,
+// and the key the connector gives new connections.
+// It's reached through database/sql with sql.Conn.Raw.
+func (c *Conn) Rekey(ctx context.Context, key string) error {
+	if err := c.keyed(ctx, "rekey", key); err != nil {
+		return err
+	}
+
+	c.connector.key.Store(key)
+	return nil
+}
+
+// run PRAGMA key or rekey, whose key is left out of traces, the history
+// and errors whether or not WithRedaction is on
+func (c *Conn) keyed(ctx context.Context, pragma, key string) error {
+	c.redactor = strings.NewReplacer(quote(key), "'<key>'")
+	defer func() { c.redactor = nil }()
+
+	if _, err := c.exec(ctx, "PRAGMA "+pragma+" = "+quote(key)+";"); err != nil {
+		return fmt.Errorf("PRAGMA %s: %w", pragma, err)
+	}
+	return nil
+}
+
+// BackupError is the error of a Backup whose destination can't be written
+type BackupError struct {
+	Path string // the destination, as the child resolves it
+	Err  error
+}
+
+func (e *BackupError) Error() string {
+	return "backup to " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *BackupError) Unwrap() error {
+	return e.Err
+}
+
+// how often Backup looks at how much of the copy is written
+const backupPoll = 100 * time.Millisecond
+
+// Backup copies the main database to the file dest with .backup, which
+// sqlite3 does with the online backup API, a hundred pages at a time.
+// A relative dest is in the connector's directory, as the database is.
+// If progress isn't nil, it's called with how many of the pages are
+// copied, as the copy grows and once it's done. If ctx is done, the
+// child is killed and the copy left as it was. An unwritable dest
+// is a *BackupError.
+// It's reached through database/sql with sql.Conn.Raw.
+func (c *Conn) Backup(ctx context.Context, dest string, progress func(pages, total int)) error {
+	if dest == "" {
+		return &BackupError{Path: dest, Err: errors.New("no destination")}
+	}
+	if dir := c.connector.dir; dir != "" && !filepath.IsAbs(dest) {
+		dest = filepath.Join(dir, dest)
+	}
+
+	// find out up front whether dest can be written, since sqlite3 only says
+	// that it couldn't open it
+	_, err := os.Stat(dest)
+	created := errors.Is(err, os.ErrNotExist)
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return &BackupError{Path: dest, Err: err}
+	}
+	f.Close()
+
+	var size, total int
+	rows, err := c.query(ctx, "SELECT page_size, page_count FROM pragma_page_size, pragma_page_count;")
+	if err == nil {
+		row := make([]driver.Value, 2)
+		if err = rows.Next(row); err == nil {
+			s, _ := row[0].(int64)
+			n, _ := row[1].(int64)
+			size, total = int(s), int(n)
+		}
+		rows.Close()
+	}
+	if err != nil {
+		if created {
+			os.Remove(dest)
+		}
+		return err
+	}
+
+	done := make(chan struct{})
+	last := -1
+	var polled sync.WaitGroup
+	if progress != nil && size > 0 {
+		polled.Add(1)
+		go func() {
+			defer polled.Done()
+			t := time.NewTicker(backupPoll)
+			defer t.Stop()
+
+			for {
+				select {
+				case <-done:
+					return
+				case <-t.C:
+				}
+				fi, err := os.Stat(dest)
+				if err != nil {
+					continue
+				}
+				if pages := min(int(fi.Size()/int64(size)), total); pages != last {
+					last = pages
+					progress(pages, total)
+				}
+			}
+		}()
+	}
+
+	_, err = c.exec(ctx, ".backup main "+dotArgument(dest))
+	close(done)
+	polled.Wait()
+
+	if err != nil {
+		// sqlite3 rolls back what it wrote to a file that was already there
+		if created {
+			os.Remove(dest)
+		}
+		var e *Error
+		if ctx.Err() == nil && errors.As(err, &e) {
+			return &BackupError{Path: dest, Err: err}
+		}
+		return err
+	}
+
+	if progress != nil && last != total {
+		progress(total, total)
+	}
+	return nil
+}
+
+// Backup is Conn.Backup, on a connection of db
+func Backup(ctx context.Context, db *sql.DB, dest string, progress func(pages, total int)) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(dc any) error {
+		c, ok := dc.(*Conn)
+		if !ok {
+			return fmt.Errorf("not a connection of this driver: %T", dc)
+		}
+		return c.Backup(ctx, dest, progress)
+	})
+}
+
+// s as one argument of a dot command, which sqlite3 unescapes in double quotes
+func dotArgument(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+	return `"` + r.Replace(s) + `"`
+}
+
+func (c *Conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *Conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	// sqlite transactions are always serializable
+	switch level := sql.IsolationLevel(opts.Isolation); level {
+	case sql.LevelDefault, sql.LevelSerializable:
+	default:
+		return nil, fmt.Errorf("isolation level %s is not supported", level)
+	}
+
+	lock := c.connector.txlock
+	if l, ok := ctx.Value(txLockKey{}).(TxLock); ok {
+		lock = l
+	}
+
+	switch lock {
+	case Deferred, Immediate, Exclusive:
+	default:
+		return nil, fmt.Errorf("unknown transaction locking mode: %s", lock)
+	}
+
+	tx := &Tx{Conn: c, parent: c.tx}
+	query := "BEGIN " + string(lock)
+
+	// nested transactions are emulated with savepoints,
+	// which take their locks from the outermost transaction
+	depth := 0
+	for p := tx.parent; p != nil; p = p.parent {
+		if p.readonly {
+			opts.ReadOnly = false // already enforced
+		}
+		depth++
+	}
+
+	if depth > 0 {
+		tx.savepoint = "sp" + strconv.Itoa(depth)
+		query = "SAVEPOINT " + tx.savepoint
+	} else if err := c.acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	if opts.ReadOnly {
+		if _, err := c.prepare("PRAGMA query_only=ON").ExecContext(ctx, nil); err != nil {
+			if depth == 0 {
+				c.release(c.busy)
+			}
+			return nil, err
+		}
+		tx.readonly = true
+	}
+
+	c.owner.held.Store(true)
+	if _, err := c.prepare(query).ExecContext(ctx, nil); err != nil {
+		c.owner.held.Store(c.tx != nil)
+		if tx.readonly {
+			c.prepare("PRAGMA query_only=OFF").Exec(nil)
+		}
+		if depth == 0 {
+			c.release(c.busy)
+		}
+		return nil, err
+	}
+
+	c.tx = tx
+	return tx, nil
+}
+
+// finish the transaction, along with any still nested inside of it
+func (t *Tx) end(query string) error {
+	if t.done {
+		return fmt.Errorf("transaction has already been committed or rolled back")
+	}
+
+	readonly := false
+	for tx := t.Conn.tx; tx != t.parent; tx = tx.parent {
+		readonly = readonly || tx.readonly
+		tx.done = true
+	}
+	t.Conn.tx = t.parent
+	t.Conn.owner.held.Store(t.parent != nil)
+
+	if t.parent == nil {
+		defer func() {
+			t.release(t.busy)
+		}()
+	}
+
+	select {
+	case <-t.pipeline.Done():
+		// the child exited mid-transaction, so its work is lost
+		return driver.ErrBadConn
+	default:
+	}
+
+	_, err := t.prepare(query).Exec(nil)
+
+	// sent separately, since the shell skips the rest of a failed line
+	if readonly {
+		if _, perr := t.prepare("PRAGMA query_only=OFF").Exec(nil); perr != nil {
+			t.reset = append(t.reset, "PRAGMA query_only=OFF;")
+			if err == nil {
+				err = perr
+			}
+		}
+	}
+
+	return err
+}
+
+func (t *Tx) Rollback() error {
+	if t.savepoint != "" {
+		// ROLLBACK TO leaves the savepoint on the stack
+		return t.end("ROLLBACK TO " + t.savepoint + "; RELEASE " + t.savepoint)
+	}
+	return t.end("ROLLBACK")
+}
+
+func (t *Tx) Commit() error {
+	if t.savepoint != "" {
+		return t.end("RELEASE " + t.savepoint)
+	}
+	return t.end("COMMIT")
+}
+
+// with RETURNING, last_insert_rowid() after the statement
+func (r *Result) LastInsertId() (int64, error) {
+	if r.id != nil {
+		return *r.id, nil
+	}
+	return 0, fmt.Errorf("unimplemented")
+}
+
+// with RETURNING, the number of rows returned
+func (r *Result) RowsAffected() (int64, error) {
+	if r.rows != nil {
+		return int64(len(r.rows)), nil
+	}
+	return 0, fmt.Errorf("unimplemented")
+}
+
+// Returned gives the columns and rows produced by a RETURNING clause
+func (r *Result) Returned() ([]string, [][]driver.Value) {
+	return r.names, r.rows
+}
+
+func (r *Rows) Columns() []string {
+	return r.header
+}
+
+// QualifiedColumns returns the names of the columns as sqlite3 names them
+// with StmtOptions.QualifiedNames, which tell apart the columns of two tables
+// of the same name, as in a.id & b.id; nil without it. A query without rows
+// has them unqualified, as do the columns of subqueries & expressions.
+func (r *Rows) QualifiedColumns() []string {
+	return r.qualified
+}
+
+// skips whatever is left of the current result set
+func (r *Rows) HasNextResultSet() bool {
+	dest := make([]driver.Value, len(r.header))
+	for {
+		switch err := r.Next(dest); err {
+		case nil:
+		case io.EOF:
+			return r.next
+		default:
+			return false
+		}
+	}
+}
+
+func (r *Rows) NextResultSet() error {
+	if !r.HasNextResultSet() {
+		return io.EOF
+	}
+
+	r.next = false
+	r.peeked = false
+	r.header = nil
+	r.decoders = nil
+	r.n = 0
+
+	// the header
+	if err := r.parse(nil); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func (r *Rows) Close() error {
+	// the reader discards whatever the child prints after this,
+	// wait for it to get to the end so the next query starts clean
+	r.cancel()
+
+	if r.str != nil {
+		release(r.str)
+		r.str = nil
+	}
+
+	select {
+	case <-r.done:
+	case <-r.conn.Done():
+		for _, err := range r.conn.owner.errs {
+			if err != nil {
+				return err
+			}
+		}
+		return r.conn.Err()
+	}
+	return nil
+}
+
+func (e *ParseError) Error() string {
+	s := e.msg
+	switch {
+	case e.Row == 0:
+		s += ", in the header"
+	default:
+		s += fmt.Sprintf(", in row %d", e.Row)
+	}
+	switch {
+	case e.Column < 0:
+	case e.Name != "":
+		s += fmt.Sprintf(", column %d (%s)", e.Column, e.Name)
+	default:
+		s += fmt.Sprintf(", column %d", e.Column)
+	}
+	s += fmt.Sprintf(", at %q", e.Excerpt)
+	if e.Query != "" {
+		s += fmt.Sprintf("\nquery: %q", e.Query)
+	}
+	if e.Sent != nil || e.Received != nil {
+		s += fmt.Sprintf("\nsent: %q\nreceived: %q", e.Sent, e.Received)
+	}
+	return s
+}
+
+func (r *Rows) Next(dest []driver.Value) error {
+	// closing the statement abandons rows already read off the pipe, too
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+
+	if r.peeked {
+		r.peeked = false
+		copy(dest, r.ahead)
+		return r.aheadErr
+	}
+	return r.parse(dest)
+}
+
+// parse the next row ahead of Next, for column metadata
+func (r *Rows) peek() []driver.Value {
+	if !r.peeked {
+		// the caller may still be scanning the last row's blobs
+		r.blobs = nil
+		r.ahead = make([]driver.Value, len(r.header))
+		// its text is left as strings, for the column types to tell from blobs
+		raw := r.rawText
+		r.rawText = false
+		r.aheadErr = r.parse(r.ahead)
+		r.rawText = raw
+		r.peeked = true
+	}
+
+	if r.aheadErr != nil {
+		return nil
+	}
+	return r.ahead
+}
+
+// the declared type when known, otherwise the storage class
+// of the column's value in the first row, as typeof() would say
+func (r *Rows) ColumnTypeDatabaseTypeName(index int) string {
+	if col := r.column(index); col != nil && col.decl != "" {
+		decl, _, _ := strings.Cut(col.decl, "(")
+		return strings.ToUpper(strings.TrimSpace(decl))
+	}
+
+	if row := r.peek(); index < len(row) {
+		switch row[index].(type) {
+		case int, int64:
+			return "INTEGER"
+		case float64:
+			return "REAL"
+		case string:
+			return "TEXT"
+		case []byte:
+			return "BLOB"
+		}
+	}
+	return ""
+}
+
+func (r *Rows) ColumnTypeNullable(index int) (nullable, ok bool) {
+	if col := r.column(index); col != nil {
+		return !col.notnull, true
+	}
+	return false, false
+}
+
+func (r *Rows) ColumnTypeLength(index int) (length int64, ok bool) {
+	col := r.column(index)
+	if col == nil {
+		return 0, false
+	}
+
+	if args := col.args(); len(args) == 1 {
+		return args[0], true
+	}
+
+	// text & blob are only limited by SQLITE_MAX_LENGTH
+	switch affinity(col.decl) {
+	case "TEXT", "BLOB":
+		return math.MaxInt64, true
+	default:
+		return 0, false
+	}
+}
+
+func (r *Rows) ColumnTypePrecisionScale(index int) (precision, scale int64, ok bool) {
+	col := r.column(index)
+	if col == nil {
+		return 0, 0, false
+	}
+
+	switch args := col.args(); {
+	case affinity(col.decl) != "NUMERIC":
+		return 0, 0, false
+	case len(args) == 1:
+		return args[0], 0, true
+	case len(args) == 2:
+		return args[0], args[1], true
+	default:
+		return 0, 0, false
+	}
+}
+
+// declared metadata of the column, nil if unknown; it's looked up with the
+// query, as another query while the rows are read waits for them all
+func (r *Rows) column(index int) *column {
+	if len(r.columns) != len(r.header) {
+		r.columns = make([]*column, len(r.header))
+	}
+	if index < len(r.columns) {
+		return r.columns[index]
+	}
+	return nil
+}
+
+// numbers in the parentheses of the declared type, as in DECIMAL(10,2)
+func (c *column) args() []int64 {
+	_, s, ok := strings.Cut(c.decl, "(")
+	if s, ok = strings.CutSuffix(strings.TrimSpace(s), ")"); !ok {
+		return nil
+	}
+
+	var args []int64
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.ParseInt(strings.TrimSpace(f), 10, 64)
+		if err != nil {
+			return nil
+		}
+		args = append(args, n)
+	}
+	return args
+}
+
+// type affinity of a declared type, following the rules in sqlite's datatype3.html
+func affinity(decl string) string {
+	decl = strings.ToUpper(decl)
+	switch {
+	case strings.Contains(decl, "INT"):
+		return "INTEGER"
+	case strings.Contains(decl, "CHAR"), strings.Contains(decl, "CLOB"), strings.Contains(decl, "TEXT"):
+		return "TEXT"
+	case strings.Contains(decl, "BLOB"), decl == "":
+		return "BLOB"
+	case strings.Contains(decl, "REAL"), strings.Contains(decl, "FLOA"), strings.Contains(decl, "DOUB"):
+		return "REAL"
+	default:
+		return "NUMERIC"
+	}
+}
+
+// declared metadata of the result columns of query, which is only known
+// for simple queries of the form SELECT columns FROM table, and otherwise nil
+func (c *Conn) declared(ctx context.Context, query string) []*column {
+	table, items, ok := simpleSelect(query)
+	if !ok {
+		return nil
+	}
+
+	rows, err := c.query(ctx, "SELECT name, type, \"notnull\", pk FROM pragma_table_info("+quote(table)+");")
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var names []string
+	decls := make(map[string]*column)
+	dest := make([]driver.Value, 4)
+	for rows.Next(dest) == nil {
+		name, _ := dest[0].(string)
+		decl, _ := dest[1].(string)
+		notnull, _ := dest[2].(int64)
+		pk, _ := dest[3].(int64)
+		// INTEGER PRIMARY KEY is the rowid, which is never NULL
+		integer := pk == 1 && strings.EqualFold(decl, "INTEGER")
+		names = append(names, strings.ToLower(name))
+		decls[strings.ToLower(name)] = &column{decl: decl, notnull: notnull != 0 || integer}
+	}
+
+	var resolved []*column
+	for _, item := range items {
+		if item == "*" {
+			for _, name := range names {
+				resolved = append(resolved, decls[name])
+			}
+		} else {
+			resolved = append(resolved, decls[strings.ToLower(item)])
+		}
+	}
+	return resolved
+}
+
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// QuoteString gives s as arguments are bound, for SQL built at runtime: a
+// string literal, or, for text of many lines or of \r\n, which sqlite3
+// reads a line at a time, an expression giving it, CAST(base64('...') AS TEXT)
+func QuoteString(s string) string {
+	var b bytes.Buffer
+	encode(&b, s, &Connector{})
+	return b.String()
+}
+
+// QuoteIdentifier gives name in double quotes, as the name of a table,
+// column or the like, which no keyword is taken for
+func QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// QuoteBlob gives b as a blob literal, X'0A0B'
+func QuoteBlob(b []byte) string {
+	return "X'" + strings.ToUpper(hex.EncodeToString(b)) + "'"
+}
+
+// split a query into rough tokens: words, quoted strings & identifiers, and punctuation
+func tokenize(query string) []string {
+	word := func(c byte) bool {
+		return c == '_' || c == '$' || c >= 0x80 ||
+			c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+	}
+
+	var tokens []string
+	for i := 0; i < len(query); {
+		switch c := query[i]; {
+		case c == ' ', c == '\t', c == '\n', c == '\r', c == '\f':
+			i++
+		case strings.HasPrefix(query[i:], "--"):
+			if j := strings.IndexByte(query[i:], '\n'); j < 0 {
+				i = len(query)
+			} else {
+				i += j
+			}
+		case strings.HasPrefix(query[i:], "/*"):
+			if j := strings.Index(query[i+2:], "*/"); j < 0 {
+				i = len(query)
+			} else {
+				i += j + 4
+			}
+		case c == '\'', c == '"', c == '`', c == '[':
+			end := c
+			if c == '[' {
+				end = ']'
+			}
+			j := i + 1
+			for ; j < len(query); j++ {
+				if query[j] != end {
+					continue
+				} else if end != ']' && j+1 < len(query) && query[j+1] == end {
+					j++ // doubled to escape
+				} else {
+					break
+				}
+			}
+			j = min(j+1, len(query))
+			tokens = append(tokens, query[i:j])
+			i = j
+		case word(c):
+			j := i
+			for j < len(query) && word(query[j]) {
+				j++
+			}
+			tokens = append(tokens, query[i:j])
+			i = j
+		default:
+			tokens = append(tokens, query[i:i+1])
+			i++
+		}
+	}
+	return tokens
+}
+
+// name of an identifier token, unquoted
+func ident(token string) (string, bool) {
+	switch c := token[0]; {
+	case c == '"', c == '`':
+		q := token[:1]
+		if len(token) < 2 || token[len(token)-1] != c {
+			return "", false
+		}
+		return strings.ReplaceAll(token[1:len(token)-1], q+q, q), true
+	case c == '[':
+		return strings.Trim(token, "[]"), true
+	case c == '\'', c >= '0' && c <= '9', len(token) == 1 && !unicode.IsLetter(rune(c)) && c != '_':
+		return "", false
+	default:
+		return token, true
+	}
+}
+
+// for queries of the form SELECT columns FROM table, the table, and the
+// column of the table each result column is, "*" for all of them, or ""
+// if it's some other expression
+func simpleSelect(query string) (table string, items []string, ok bool) {
+	tokens := tokenize(query)
+	keyword := func(i int, words ...string) bool {
+		for _, w := range words {
+			if i < len(tokens) && strings.EqualFold(tokens[i], w) {
+				return true
+			}
+		}
+		return false
+	}
+
+	i := 0
+	if !keyword(i, "SELECT") {
+		return "", nil, false
+	}
+	i++
+	if keyword(i, "ALL", "DISTINCT") {
+		i++
+	}
+
+	// the select list, with qualifiers kept aside until the table's alias is known
+	type item struct{ qualifier, name string }
+	var list []item
+	for {
+		start, depth := i, 0
+		for ; i < len(tokens); i++ {
+			if tokens[i] == "(" {
+				depth++
+			} else if tokens[i] == ")" {
+				depth--
+			} else if depth == 0 && (tokens[i] == "," || keyword(i, "FROM")) {
+				break
+			}
+		}
+		if i >= len(tokens) {
+			return "", nil, false
+		}
+
+		expr := tokens[start:i]
+		// drop the alias, which doesn't change the declared type
+		if n := len(expr); n >= 3 && keyword(start+n-2, "AS") {
+			expr = expr[:n-2]
+		} else if n == 2 {
+			if _, ok := ident(expr[1]); ok {
+				expr = expr[:1]
+			}
+		}
+
+		var it item
+		switch len(expr) {
+		case 1:
+			if expr[0] == "*" {
+				it.name = "*"
+			} else if name, ok := ident(expr[0]); ok {
+				it.name = name
+			}
+		case 3:
+			qualifier, ok := ident(expr[0])
+			if expr[1] == "." && ok {
+				it.qualifier = qualifier
+				if expr[2] == "*" {
+					it.name = "*"
+				} else if name, ok := ident(expr[2]); ok {
+					it.name = name
+				}
+			}
+		}
+		list = append(list, it)
+
+		if tokens[i] == "," {
+			i++
+			continue
+		}
+		break
+	}
+
+	// FROM [schema.]table [[AS] alias]
+	i++
+	name, ok := "", false
+	if i < len(tokens) {
+		name, ok = ident(tokens[i])
+	}
+	if !ok {
+		return "", nil, false
+	}
+	i++
+	table = name
+	if i+1 < len(tokens) && tokens[i] == "." {
+		// pragma_table_info searches every schema
+		if table, ok = ident(tokens[i+1]); !ok {
+			return "", nil, false
+		}
+		i += 2
+	}
+
+	alias := table
+	if keyword(i, "AS") {
+		i++
+	}
+	if i < len(tokens) && !keyword(i, "WHERE", "GROUP", "HAVING", "ORDER", "LIMIT", "WINDOW") && tokens[i] != ";" {
+		if alias, ok = ident(tokens[i]); !ok {
+			return "", nil, false
+		}
+		i++
+	}
+
+	// anything but the end of the statement means joins & such
+	if i < len(tokens) && !keyword(i, "WHERE", "GROUP", "HAVING", "ORDER", "LIMIT", "WINDOW") && tokens[i] != ";" {
+		return "", nil, false
+	}
+	for j := i; j < len(tokens); j++ {
+		if tokens[j] == ";" && j+1 < len(tokens) && tokens[j+1] != ";" {
+			return "", nil, false // more than one statement
+		}
+	}
+
+	for _, it := range list {
+		if it.qualifier != "" && !strings.EqualFold(it.qualifier, alias) && !strings.EqualFold(it.qualifier, table) {
+			return "", nil, false
+		}
+		items = append(items, it.name)
+	}
+	return table, items, true
+}
+
+func (r *Rows) ColumnTypeScanType(index int) reflect.Type {
+	if row := r.peek(); index < len(row) {
+		switch row[index].(type) {
+		case int, int64:
+			return reflect.TypeOf(int64(0))
+		case float64:
+			return reflect.TypeOf(float64(0))
+		case string:
+			return reflect.TypeOf("")
+		case []byte:
+			return reflect.TypeOf([]byte(nil))
+		case time.Time:
+			return reflect.TypeOf(time.Time{})
+		case bool:
+			return reflect.TypeOf(false)
+		case uint64:
+			return reflect.TypeOf(uint64(0))
+		case *big.Int:
+			return reflect.TypeOf((*big.Int)(nil))
+		case *big.Float:
+			return reflect.TypeOf((*big.Float)(nil))
+		}
+	}
+	// NULL, or no rows to tell from
+	return reflect.TypeOf((*any)(nil)).Elem()
+}
+
+// parse the next row into dest, or with dest nil, the header
+func (r *Rows) parse(dest []driver.Value) (err error) {
+	defer func() {
+		if e, ok := err.(*ParseError); ok {
+			e.Query = r.redacted(r.query)
+			e.Sent, e.Received = r.conn.History()
+		}
+
+		if err == nil && dest == nil && r.qualifies {
+			r.unqualify(r.sets)
+		}
+
+		// in .mode json, the first row comes with the header
+		row := dest
+		if row == nil && r.peeked {
+			row = r.ahead
+		}
+		if err == nil && row != nil && r.converts() {
+			r.convert(row)
+		}
+		if err == nil && row != nil && r.decoding {
+			if e := r.decode(row); dest != nil {
+				err = e
+			} else {
+				r.aheadErr = e
+			}
+		}
+
+		// where the rest of the output picks up is anyone's guess,
+		// and past an error sqlite3 printed, there's nothing more
+		if err != nil && err != io.EOF {
+			r.cancel()
+		}
+	}()
+
+	// Close has given the buffer back
+	if r.str == nil {
+		return r.ctx.Err()
+	}
+
+	if r.json {
+		return r.parseJSON(dest)
+	}
+
+	for {
+		// a header skipped would have the first row taken for it
+		err = r.parser.parse(dest)
+		if dest == nil || !r.resync || !failed(err) {
+			return err
+		}
+		if report := r.conn.connector.skipped; report != nil {
+			if e, ok := err.(*ParseError); ok {
+				e.Query = r.redacted(r.query)
+				e.Sent, e.Received = r.conn.History()
+			}
+			report(err)
+		}
+	}
+}
+
+// parse the next row into dest, or with dest nil, the header,
+// getting more of the output from more once buf is used up
+func (p *parser) parse(dest []driver.Value) (err error) {
+	var i, n int       // i - dest index, n - token index
+	var v int64        // value of an integer, whose text is kept in str too
+	var neg, over bool // v is negative, v overflowed
+	var b byte
+	var blob []byte
+	handle := func(s string) *ParseError {
+		if p.n == 0 {
+			return p.parseError(s, len(p.header))
+		}
+		return p.parseError(s, i)
+	}
+	// a row of more values than dest is counted, for the error
+	put := func(v driver.Value) {
+		if i < len(dest) {
+			dest[i] = v
+		}
+		i++
+	}
+
+	const (
+		NONE int = iota
+		STRING
+		X                        // start of blob literal
+		BLOB                     // sqlite blob literal X'0a0a0a' -> \n\n\n
+		SIGN                     // +/- preceding a number
+		NUMERIC                  // we see digits, but no decimal - could be int or float
+		DECIMAL                  // we saw the decimal, now expecting digits or e
+		E                        // saw e, now expecting a sign or digits
+		EXPONENT                 // after value, expecting more digits, white space or ,
+		NULL                     // NULL
+		INF                      // Inf, an infinite real, after the sign if any
+		EOR                      // END OF RECORD
+		PARSE                    // Parse error
+		RUNTIME                  // Runtime error
+		SEPARATOR                // line between the output of two statements
+		SAFE                     // refused by -safe, after which sqlite3 exits
+		ESCAPED   = 0x10 << iota // white space after a value
+		ERR                      // Error
+	)
+
+	defer func() {
+		if failed(err) {
+			// from a known state: the start of the next row. past
+			// WithMaxRowSize, that may be from within a string or blob
+			p.skip, p.quoted = true, p.s == STRING || p.s == BLOB
+			p.s = NONE
+			p.str.Reset()
+			p.broken = err
+			// the rows after are numbered as in the output
+			if p.n > 0 {
+				p.n++
+			}
+		}
+	}()
+
+	if err := p.resynchronize(); err != nil {
+		return err
+	}
+
+	if p.next {
+		return io.EOF
+	}
+
+	p.start = p.taken + p.i
+	if dest != nil {
+		p.raw = p.raw[:0]
+	}
+
+	for p.s != EOR {
+		if p.i >= len(p.buf) {
+			if p.more == nil {
+				return errShort
+			}
+			if err := p.more(); err != nil {
+				if err == io.EOF && p.s == NONE {
+					if err := p.headerless(); err != nil {
+						return err
+					}
+				}
+				return err
+			}
+			continue
+		}
+
+		if p.maxRow > 0 && p.taken+p.i-p.start > p.maxRow {
+			return ErrRowTooBig
+		}
+
+		c := p.buf[p.i]
+		// lines may end in \r\n, which is only kept within a string
+		if c == '\r' && p.s != STRING {
+			p.i++
+			continue
+		}
+		if p.s == NONE {
+			p.at = p.taken + p.i
+		}
+
+		switch p.s {
+		case NONE:
+			switch c {
+			case '-':
+				v, neg, over = 0, true, false
+				p.str.WriteByte(c)
+				p.s = NUMERIC
+			case '+':
+				v, neg, over = 0, false, false
+				p.s = NUMERIC
+			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+				v, neg, over = int64(c-'0'), false, false
+				p.str.WriteByte(c)
+				p.s = NUMERIC
+			case '.':
+				p.str.WriteByte(c)
+				p.s = DECIMAL
+			case '\'':
+				p.s = STRING
+			case 'N':
+				p.s = NULL
+				n = 1
+			case 'I':
+				p.s = INF
+				n = 1
+				neg = false
+			case 'X':
+				p.s = X
+				n = 0
+			case '#':
+				p.s = SEPARATOR
+			case 'E':
+				p.s = ERR
+				n = 1
+				p.str.WriteByte(c)
+			case 'P':
+				p.s = ERR | PARSE
+				n = 1
+				p.str.WriteByte(c)
+			case 'R':
+				p.s = ERR | RUNTIME
+				n = 1
+				p.str.WriteByte(c)
+			case 'l':
+				p.s = ERR | SAFE
+				n = 1
+				p.str.WriteByte(c)
+			case ',':
+				return handle("expecting something before comma")
+			default:
+				return handle("expecting a number or a string")
+			}
+		case X:
+			switch c {
+			case '\'':
+				if i < len(p.blobs) {
+					blob = p.blobs[i][:0]
+				} else {
+					blob = []byte{}
+				}
+				p.s = BLOB
+			default:
+				return handle("expecting a quote after X")
+			}
+		case BLOB:
+			if c == '\'' {
+				if n != 0 {
+					return handle("odd number of digits in blob")
+				}
+				p.s |= ESCAPED
+				break
+			}
+
+			// the digits at hand in one go, rather than a byte at a time
+			run := p.buf[p.i:]
+			if j := bytes.IndexByte(run, '\''); j >= 0 {
+				run = run[:j]
+			}
+			if n == 1 {
+				// with the digit left at the end of the last of the output
+				var x [1]byte
+				if _, err := hex.Decode(x[:], []byte{b, c}); err != nil {
+					return handle(fmt.Sprintf("expecting hex digits but got %c", c))
+				}
+				blob = append(blob, x[0])
+				run, n = run[1:], 0
+				p.i++
+			}
+			m := len(run) &^ 1
+			blob = slices.Grow(blob, m/2)
+			k, err := hex.Decode(blob[len(blob):len(blob)+m/2], run[:m])
+			if err != nil {
+				// at the digit which isn't one, of the pair which failed
+				p.i += 2 * k
+				if e, ok := err.(hex.InvalidByteError); ok && p.buf[p.i] != byte(e) {
+					p.i++
+				}
+				return handle(fmt.Sprintf("expecting hex digits but got %c", p.buf[p.i]))
+			}
+			blob = blob[:len(blob)+m/2]
+			p.i += m
+			if m < len(run) {
+				b, n = run[m], 1
+				p.i++
+			}
+			continue
+		case BLOB | ESCAPED:
+			switch c {
+			case ',':
+				p.reuse(i, blob)
+				put(blob)
+				p.s = NONE
+			case '\n':
+				p.reuse(i, blob)
+				put(blob)
+				p.s = EOR
+			default:
+				return handle(fmt.Sprintf("expecting comma or white space but got %c", c))
+			}
+		case NULL:
+			null := "NULL"
+			if n >= len(null) {
+				// no-op
+			} else if c != null[n] {
+				return handle("NULL mispelled")
+			} else {
+				n++
+				break
+			}
+			switch c {
+			case ',':
+				put(nil)
+				n = 0
+				p.s = NONE
+			case '\n':
+				put(nil)
+				n = 0
+				p.s = EOR
+			}
+		case INF:
+			inf := "Inf"
+			if n < len(inf) {
+				if c != inf[n] {
+					return handle("Inf mispelled")
+				}
+				n++
+				break
+			}
+			switch c {
+			case ',', '\n':
+				if neg {
+					p.str.WriteByte('-')
+				}
+				p.str.WriteString(inf)
+				x, err := p.real()
+				if err != nil {
+					return err
+				}
+				put(x)
+				n = 0
+				if c == ',' {
+					p.s = NONE
+				} else {
+					p.s = EOR
+				}
+			default:
+				return handle("expecting comma or white space")
+			}
+		case ERR, ERR | PARSE, ERR | RUNTIME, ERR | SAFE:
+			var token string
+			switch p.s & (^ERR) {
+			case PARSE:
+				token = "Parse error"
+			case RUNTIME:
+				token = "Runtime error"
+			case SAFE:
+				token = "line "
+			case 0:
+				token = "Error"
+			default:
+				return handle("unexpected error condition")
+			}
+			if n >= len(token) {
+				// no-op
+			} else if c != token[n] {
+				return handle("unexpected error token")
+			} else {
+				n++
+			}
+			switch c {
+			case '\n':
+				s := p.str.String()
+				p.str.Reset()
+				p.s = NONE
+				p.i++
+				if p.fail != nil {
+					return p.fail(s)
+				}
+				return newError(s, "", 0)
+			default:
+				p.str.WriteByte(c)
+			}
+		case SEPARATOR:
+			if c != '\n' {
+				break
+			}
+			p.s = NONE
+			if err := p.headerless(); err != nil {
+				return err
+			}
+			p.sets++
+			// statements other than queries print nothing, and make no result set
+			if p.n > 0 {
+				p.i++
+				p.next = true
+				return io.EOF
+			}
+		case STRING | ESCAPED:
+			switch c {
+			case '\'':
+				p.str.WriteByte(c)
+				p.s &= ^ESCAPED
+			case ',':
+				p.s = NONE
+				if p.n == 0 {
+					p.header = append(p.header, p.str.String())
+					p.str.Reset()
+					break
+				}
+				x, err := p.text()
+				if err != nil {
+					return err
+				}
+				put(x)
+			case '\n':
+				p.s = EOR
+				if p.n == 0 {
+					p.header = append(p.header, p.str.String())
+					p.str.Reset()
+					break
+				}
+				x, err := p.text()
+				if err != nil {
+					return err
+				}
+				put(x)
+			default:
+				return handle(fmt.Sprintf("unexpected character: %c", c))
+			}
+		case STRING:
+			switch c {
+			case '\'':
+				p.s |= ESCAPED
+			default:
+				p.str.WriteByte(c)
+			}
+		case NUMERIC:
+			switch c {
+			case '\n':
+				x, err := p.integer(v, over)
+				if err != nil {
+					return err
+				}
+				put(x)
+				p.s = EOR
+			case ',':
+				x, err := p.integer(v, over)
+				if err != nil {
+					return err
+				}
+				put(x)
+				p.s = NONE
+			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+				p.str.WriteByte(c)
+				if !over {
+					v, over = digit(v, c, neg)
+				}
+			case '.':
+				p.str.WriteByte(c)
+				p.s = DECIMAL
+			case 'e', 'E':
+				p.str.WriteByte(c)
+				p.s = E
+			case 'I':
+				// only right after the sign
+				if p.str.Len() > 1 || p.str.Len() == 1 && !neg {
+					return handle("expecting digits, decimal, comma or white space")
+				}
+				p.str.Reset()
+				p.s = INF
+				n = 1
+			default:
+				return handle("expecting decimal, comma or white space")
+			}
+		case E:
+			switch c {
+			case '-', '+', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+				p.str.WriteByte(c)
+				p.s = EXPONENT
+			default:
+				return handle("expecting a sign or digits of the exponent")
+			}
+		case DECIMAL, EXPONENT:
+			switch c {
+			case '\n', ',':
+				f, err := p.real()
+				if err == ErrFloatRange {
+					return err
+				} else if err != nil {
+					return handle(err.Error())
+				}
+				put(f)
+				if c == ',' {
+					p.s = NONE
+				} else {
+					p.s = EOR
+				}
+			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+				p.str.WriteByte(c)
+			case 'e', 'E':
+				if p.s == EXPONENT {
+					return handle("expecting digits, white space or comma")
+				}
+				p.str.WriteByte(c)
+				p.s = E
+			default:
+				return handle("expecting digits, white space or comma")
+			}
+		}
+		p.i++
+	}
+
+	if p.n > 0 && i != len(dest) {
+		// from the newline, which ends the row for WithResync
+		p.i--
+		p.at = p.start
+		return p.parseError(fmt.Sprintf("row of %d values, for %d columns: %s", i, len(dest), strings.Join(p.header, ", ")), min(i, len(dest)))
+	}
+
+	p.s = NONE
+	p.n++
+	return
+}
+
+// parse a row of .mode json output, which prints each result set as an array
+// of objects. the header has nothing of its own, the names are the keys of
+// the first object, whose values are kept for Next
+func (r *Rows) parseJSON(dest []driver.Value) error {
+	const (
+		NONE   int = iota // expecting an array, a separator or an error
+		OBJECT            // in an array, expecting an object
+		AFTER             // after an object, expecting a comma or the end of the array
+	)
+
+	if r.next {
+		return io.EOF
+	}
+
+	for {
+		c, err := r.skip()
+		if err == io.EOF && r.s == NONE {
+			if err := r.headerless(); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case c == '#':
+			if _, err := r.line(); err != nil {
+				return err
+			}
+			r.s = NONE
+			if err := r.headerless(); err != nil {
+				return err
+			}
+			r.sets++
+			// statements other than queries print nothing, and make no result set
+			if r.n > 0 {
+				r.next = true
+				return io.EOF
+			}
+		case c == 'E', c == 'P', c == 'R', c == 'l':
+			s, err := r.line()
+			if err != nil {
+				return err
+			}
+			return r.error(s)
+		case c == '[' && r.s == NONE:
+			r.i++
+			r.s = OBJECT
+		case c == ',' && r.s == AFTER:
+			r.i++
+			r.s = OBJECT
+		case c == ']' && r.s == AFTER:
+			r.i++
+			r.s = NONE
+		case c == '{' && r.s == OBJECT:
+			r.start = r.taken + r.i
+			r.i++
+			r.n++
+			values, err := r.object(r.n == 1)
+			if err != nil {
+				return err
+			}
+			r.s = AFTER
+			switch {
+			case dest == nil:
+				r.ahead, r.aheadErr, r.peeked = values, nil, true
+			case len(values) != len(dest):
+				r.at = r.start
+				return r.parseError(fmt.Sprintf("row of %d values, for %d columns: %s", len(values), len(dest), strings.Join(r.header, ", ")), min(len(values), len(dest)))
+			default:
+				copy(dest, values)
+			}
+			return nil
+		default:
+			return r.parseError(fmt.Sprintf("unexpected character in json: %c", c), -1)
+		}
+	}
+}
+
+// the values of an object, after its opening brace. the keys of
+// a result set's first object become the names of its columns, with header
+func (r *Rows) object(header bool) ([]driver.Value, error) {
+	var values []driver.Value
+	for {
+		c, err := r.skip()
+		if err != nil {
+			return nil, err
+		}
+
+		switch c {
+		case '}':
+			r.i++
+			return values, nil
+		case ',':
+			r.i++
+		case '"':
+			r.at = r.taken + r.i
+			key, err := r.jsonValue(len(values))
+			if err != nil {
+				return nil, err
+			}
+			if header {
+				r.header = append(r.header, key.(string))
+			}
+
+			if c, err = r.skip(); err != nil {
+				return nil, err
+			} else if c != ':' {
+				return nil, r.parseError("expecting a colon after the key", len(values))
+			}
+			r.i++
+
+			if _, err = r.skip(); err != nil {
+				return nil, err
+			}
+			r.at = r.taken + r.i
+			value, err := r.jsonValue(len(values))
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+			if r.tooBig() {
+				return nil, ErrRowTooBig
+			}
+		default:
+			r.at = r.taken + r.i
+			return nil, r.parseError(fmt.Sprintf("expecting a key but got %c", c), len(values))
+		}
+	}
+}
+
+// a string, number or null, starting at the current byte
+func (r *Rows) jsonValue(column int) (driver.Value, error) {
+	var token []byte
+	c, err := r.look()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c == '"':
+		var escaped bool
+		for {
+			token = append(token, c)
+			r.i++
+			if c, err = r.look(); err != nil {
+				return nil, err
+			}
+			if c == '"' && !escaped {
+				token = append(token, c)
+				r.i++
+				break
+			}
+			if r.tooBig() {
+				return nil, ErrRowTooBig
+			}
+			escaped = c == '\\' && !escaped
+		}
+
+		var s string
+		if err := json.Unmarshal(token, &s); err != nil {
+			return nil, r.parseError(err.Error(), column)
+		}
+		return s, nil
+	case c == 'n':
+		for _, want := range []byte("null") {
+			if c, err = r.look(); err != nil {
+				return nil, err
+			} else if c != want {
+				return nil, r.parseError("null mispelled", column)
+			}
+			r.i++
+		}
+		return nil, nil
+	case c == '-', c >= '0' && c <= '9':
+		for strings.IndexByte("+-.0123456789eE", c) >= 0 {
+			token = append(token, c)
+			r.i++
+			if c, err = r.look(); err != nil {
+				return nil, err
+			}
+		}
+
+		r.str.Write(token)
+		if n, err := strconv.ParseInt(string(token), 10, 64); err == nil || errors.Is(err, strconv.ErrRange) {
+			return r.integer(n, err != nil)
+		}
+		// sqlite3 prints infinity as 9.0e+999, which ParseFloat takes as out of range
+		f, err := r.real()
+		if err != nil && err != ErrFloatRange {
+			return nil, r.parseError(err.Error(), column)
+		}
+		return f, err
+	default:
+		return nil, r.parseError(fmt.Sprintf("expecting a value but got %c", c), column)
+	}
+}
+
+// skip the rest of a row which failed, up to the newline ending it, which
+// mayn't be the first, when the row's rest has a string with newlines in it.
+// without resync, there's no going on, and the row's error is returned
+func (p *parser) resynchronize() error {
+	if p.broken != nil && !p.resync {
+		return p.broken
+	}
+	for p.skip {
+		if p.i >= len(p.buf) {
+			if p.more == nil {
+				return errShort
+			}
+			if err := p.more(); err != nil {
+				return err
+			}
+			continue
+		}
+		switch p.buf[p.i] {
+		case '\'':
+			p.quoted = !p.quoted
+		case '\n':
+			p.skip = p.quoted
+		}
+		p.i++
+	}
+	return nil
+}
+
+// skip the line at hand, as resynchronize does a row which failed
+func (p *parser) skipLine() error {
+	p.skip, p.quoted = true, false
+	return p.resynchronize()
+}
+
+// the header of a query which printed no rows, and so none of its own
+func (p *parser) headerless() error {
+	if p.n > 0 || len(p.header) > 0 || p.probe == nil {
+		return nil
+	}
+	header, err := p.probe(p.sets)
+	if err != nil || header == nil {
+		return err
+	}
+	p.header, p.n = header, 1
+	return nil
+}
+
+// the names of a probe's header, as the query's own would have them: sqlite
+// renames a column of a subquery named as one before it, a to a:1, and with
+// QualifiedNames, qualifies them all with the probe's subquery
+func unrenamed(names []string) []string {
+	for i, name := range names {
+		if rest, ok := strings.CutPrefix(name, "q.(subquery-"); ok {
+			if _, after, ok := strings.Cut(rest, ")."); ok {
+				name = after
+				names[i] = name
+			}
+		}
+		j := strings.LastIndexByte(name, ':')
+		if j < 0 || j == len(name)-1 || strings.Trim(name[j+1:], "0123456789") != "" {
+			continue
+		}
+		if slices.Contains(names[:i], name[:j]) {
+			names[i] = name[:j]
+		}
+	}
+	return names
+}
+
+// a *ParseError at the value of column being parsed, or with column -1,
+// at the byte between rows
+func (p *parser) parseError(msg string, column int) *ParseError {
+	e := &ParseError{msg: msg, Row: p.n, Column: column}
+	if column >= 0 && column < len(p.header) {
+		e.Name = p.header[column]
+	}
+
+	// the value may have started in output that's since been dropped
+	to := min(p.i+1, len(p.buf))
+	from := p.at - p.taken
+	if column < 0 {
+		from = min(p.i, to)
+	}
+	cut := from < 0 || to-from > 32
+	from = max(from, to-32, 0)
+	e.Excerpt = strings.TrimRight(string(p.buf[from:to]), "\r\n")
+	if cut {
+		e.Excerpt = "..." + e.Excerpt
+	}
+	return e
+}
+
+// whether err is of a single row, after which the output still makes sense
+func failed(err error) bool {
+	var e *ParseError
+	return errors.As(err, &e) || err == ErrRowTooBig || err == ErrIntegerOverflow || err == ErrFloatRange ||
+		err == ErrInvalidUTF8
+}
+
+// timestamps in the formats sqlite's date & time functions take, which
+// parse fractional seconds, too
+var timeFormats = []string{
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04Z07:00",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// whether any of the values of a row are converted
+func (r *Rows) converts() bool {
+	return r.parseTime || r.bools || r.rawJSON || r.jsonNames != nil || r.unsigned
+}
+
+// the values of a row as WithParseTime, WithBooleans, WithRawJSON
+// & StmtOptions.Unsigned have them
+func (r *Rows) convert(row []driver.Value) {
+	loc := r.conn.connector.loc
+	if loc == nil {
+		loc = time.UTC
+	}
+	numeric := r.parseTime && r.conn.connector.numericTime
+	layout := r.conn.connector.timeLayout
+
+	for i, v := range row {
+		if n, ok := v.(int64); ok && n < 0 && r.unsigned {
+			row[i] = uint64(n)
+			continue
+		}
+		if r.bools && r.declares(i, "BOOL") {
+			switch v := v.(type) {
+			case int64:
+				row[i] = v != 0
+			case string:
+				if b, err := strconv.ParseBool(v); err == nil {
+					row[i] = b
 				}
-				r.i = 0
-				continue
-			case <-r.conn.pipeline.Done():
-				return io.ErrUnexpectedEOF
-			case <-r.ctx.Done():
-				return r.ctx.Err()
 			}
+			continue
+		}
+		if s, ok := v.(string); ok && r.holdsJSON(i) {
+			row[i] = []byte(s)
+			continue
+		}
+		if !r.parseTime {
+			continue
 		}
 
-		c := r.buf[r.i]
-		switch r.s {
-		case NONE:
-			switch c {
-			case '-':
-				n = -0
-				r.s = NUMERIC
-			case '+':
-				n = 0
-				r.s = NUMERIC
-			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-				if n > 0 || n == 0 {
-					n = int(c - '0')
+		switch v := v.(type) {
+		case string:
+			if t, ok := parseTime(v, loc, layout); ok {
+				row[i] = t
+			}
+		case int64:
+			if numeric && r.declares(i, "DATE", "TIMESTAMP") {
+				if layout == TimeUnixMilli {
+					row[i] = time.UnixMilli(v).In(loc)
 				} else {
-					n = 0 - int(c-'0')
+					row[i] = time.Unix(v, 0).In(loc)
 				}
-				r.s = NUMERIC
-			case '.':
-				r.s = DECIMAL
-			case '\'':
-				r.s = STRING
-			case 'N':
-				r.s = NULL
-				n = 1
-			case 'X':
-				r.s = X
-				n = 0
-			case 'E':
-				r.s = ERR
-				n = 1
-			case 'P':
-				r.s = ERR | PARSE
-				n = 1
-			case 'R':
-				r.s = ERR | RUNTIME
-				n = 1
-			case ',':
-				return handle("expecting something before comma")
-			default:
-				return handle("expecting a number or a string")
 			}
-		case X:
-			switch c {
-			case '\'':
-				blob = make([]byte, 0, 16)
-				r.s = BLOB
-			default:
-				return handle("expecting a quote after X")
+		case float64:
+			if numeric && r.declares(i, "DATE", "TIMESTAMP") && !math.IsInf(v, 0) && !math.IsNaN(v) {
+				// julian day 2440587.5 is the unix epoch
+				row[i] = time.UnixMicro(int64(math.Round((v - 2440587.5) * 86400e6))).In(loc)
 			}
-		case BLOB:
-			switch c {
-			case '\'':
-			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-				switch n {
-				case 0:
-					b = (c - '0') * 16
-					n = 1
-				case 1:
-					b += c - '0'
-					n = 0
-					blob = append(blob, b)
-				}
-			case 'a', 'b', 'c', 'd', 'e', 'f':
-				switch n {
-				case 0:
-					b = (c - 'a' + 10) * 16
-					n = 1
-				case 1:
-					b += c - 'a' + 10
-					n = 0
-					blob = append(blob, b)
-				}
-			case 'A', 'B', 'C', 'D', 'E', 'F':
-				switch n {
-				case 0:
-					b = (c - 'A' + 10) * 16
-					n = 1
-				case 1:
-					b += c - 'A' + 10
-					n = 0
-					blob = append(blob, b)
+		}
+	}
+}
+
+// the values of a row, through the decoders matching their columns
+func (r *Rows) decode(row []driver.Value) error {
+	if r.decoders == nil {
+		r.decoders = make([]Decoder, len(r.header))
+		for i, name := range r.header {
+			for _, d := range r.conn.connector.decoders {
+				if d.matches(r, i, name) {
+					r.decoders[i] = d.decode
+					break
 				}
-			case ',':
-				dest[i] = blob
-				i++
-				r.s = NONE
-				n = 0
-			case '\n':
-				dest[i] = blob
-				i++
-				r.s = EOR
-				n = 0
-			default:
-				return handle(fmt.Sprintf("expecting a quote but got %c", c))
 			}
-		case NULL:
-			null := "NULL"
-			if n >= len(null) {
-				// no-op
-			} else if c != null[n] {
-				return handle("NULL mispelled")
+		}
+	}
+
+	for i, d := range r.decoders {
+		if d == nil || i >= len(row) || row[i] == nil {
+			continue
+		}
+		v, err := d(row[i])
+		if err != nil {
+			return fmt.Errorf("decoding column %s: %w", r.header[i], err)
+		}
+		row[i] = v
+	}
+	return nil
+}
+
+// whether the text of column i is JSON, as WithRawJSON or StmtOptions say
+func (r *Rows) holdsJSON(i int) bool {
+	if r.rawJSON && r.declares(i, "JSON") {
+		return true
+	}
+	for _, name := range r.jsonNames {
+		if i < len(r.header) && strings.EqualFold(name, r.header[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// whether column i is declared as a type containing one of words, as looked
+// up before the query, since looking it up as the rows are read would wait for them
+func (r *Rows) declares(i int, words ...string) bool {
+	if i >= len(r.columns) || r.columns[i] == nil {
+		return false
+	}
+	decl := strings.ToUpper(r.columns[i].decl)
+	for _, word := range words {
+		if strings.Contains(decl, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// s as a time in loc, if it's in layout, in loc without a zone, as
+// WithTimeFormat gives it, or in one of timeFormats. without a
+// zone, it's in UTC, as sqlite's date & time functions have it
+func parseTime(s string, loc *time.Location, layout string) (time.Time, bool) {
+	if layout != "" && layout != TimeUnix && layout != TimeUnixMilli {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t.In(loc), true
+		}
+	}
+	// most text is ruled out without trying each
+	if len(s) < len("2006-01-02") || s[4] != '-' || s[7] != '-' {
+		return time.Time{}, false
+	}
+	for _, layout := range timeFormats {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.In(loc), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// the next of the output from the reader, in place of buf
+func (r *Rows) fetch() error {
+	select {
+	case buf, ok := <-r.ch:
+		if !ok {
+			return io.EOF
+		}
+		r.taken += len(r.buf)
+		r.buf, r.i = buf, 0
+		return nil
+	case <-r.conn.pipeline.Done():
+		return ErrExited
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+// the current byte, reading more of the output once buf is used up
+func (r *Rows) look() (byte, error) {
+	for r.i >= len(r.buf) {
+		if err := r.fetch(); err != nil {
+			return 0, err
+		}
+	}
+	return r.buf[r.i], nil
+}
+
+// whether the row being parsed has passed WithMaxRowSize
+func (r *Rows) tooBig() bool {
+	return r.maxRow > 0 && r.taken+r.i-r.start > r.maxRow
+}
+
+// the first byte past white space
+func (r *Rows) skip() (byte, error) {
+	for {
+		c, err := r.look()
+		if err != nil || (c != ' ' && c != '\t' && c != '\r' && c != '\n') {
+			return c, err
+		}
+		r.i++
+	}
+}
+
+// the rest of the line, without its newline
+func (r *Rows) line() (string, error) {
+	for {
+		c, err := r.look()
+		if err != nil {
+			return "", err
+		}
+		r.i++
+		if c == '\n' {
+			s := strings.TrimSuffix(r.str.String(), "\r")
+			r.str.Reset()
+			return s, nil
+		}
+		r.str.WriteByte(c)
+	}
+}
+
+// the string just parsed, or with raw text, a slice of the row's text
+func (p *parser) text() (driver.Value, error) {
+	defer p.str.Reset()
+	if p.utf8 != UTF8Verbatim && !utf8.Valid(p.str.Bytes()) {
+		s, err := valid(p.str.String(), p.utf8)
+		if err != nil {
+			return nil, err
+		}
+		p.str.Reset()
+		p.str.WriteString(s)
+	}
+	if !p.rawText {
+		return p.str.String(), nil
+	}
+	n := len(p.raw)
+	p.raw = append(p.raw, p.str.Bytes()...)
+	return p.raw[n:len(p.raw):len(p.raw)], nil
+}
+
+// v, with the digit c after it, and whether that overflows int64 instead
+func digit(v int64, c byte, neg bool) (int64, bool) {
+	n := int64(c - '0')
+	if neg {
+		if v < (math.MinInt64+n)/10 {
+			return v, true
+		}
+		return v*10 - n, false
+	}
+	if v > (math.MaxInt64-n)/10 {
+		return v, true
+	}
+	return v*10 + n, false
+}
+
+// the integer just parsed into v, and written to str, which is the nearest
+// float64 if it overflowed, unless WithStrictIntegers or WithExactNumbers
+func (p *parser) integer(v int64, over bool) (driver.Value, error) {
+	defer p.str.Reset()
+	switch {
+	case p.exact == ExactText:
+		return p.str.String(), nil
+	case !over:
+		return v, nil
+	case p.exact == ExactBig:
+		n, _ := new(big.Int).SetString(p.str.String(), 10)
+		return n, nil
+	case p.strictInt:
+		return nil, ErrIntegerOverflow
+	}
+	f, _ := strconv.ParseFloat(p.str.String(), 64)
+	return f, nil
+}
+
+// the real just written to str, as a float64 unless WithExactNumbers.
+// sqlite3 prints enough digits to get it back exactly, but for very large
+// & small exponents, where its printing is off by a bit
+func (p *parser) real() (driver.Value, error) {
+	defer p.str.Reset()
+	s := p.str.String()
+	f, err := strconv.ParseFloat(s, 64)
+	if errors.Is(err, strconv.ErrRange) || math.IsInf(f, 0) {
+		// ±Inf past the largest float, and 0 or so for the smallest
+		if f, err = p.outOfRange(f); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.exact == ExactText:
+		return s, nil
+	case p.exact == ExactBig && math.IsInf(f, 0):
+		return new(big.Float).SetInf(f < 0), nil
+	case p.exact == ExactBig:
+		// plenty for the 20 digits sqlite3 prints
+		b, _, err := big.ParseFloat(s, 10, 128, big.ToNearestEven)
+		return b, err
+	}
+	return f, nil
+}
+
+// f, which is infinite or out of range, unless WithStrictReals has that fail
+func (p *parser) outOfRange(f float64) (float64, error) {
+	if p.strictReal {
+		return 0, ErrFloatRange
+	}
+	return f, nil
+}
+
+// have the next row's blob in column i use the memory of this one's,
+// as driver.Rows allows
+func (p *parser) reuse(i int, blob []byte) {
+	for len(p.blobs) <= i {
+		p.blobs = append(p.blobs, nil)
+	}
+	p.blobs[i] = blob
+}
+
+// convert an argument to one of the types encode understands
+func convert(value any, p Uint64Policy) (driver.Value, error) {
+	switch v := value.(type) {
+	case nil, string, int64, bool, float64, []byte, time.Time, literal, list:
+		return v, nil
+	// the smaller integers all fit in an int64; unsigned ones past it are
+	// as p says, and a time.Duration is its nanoseconds, as database/sql has it
+	case int:
+		return int64(v), nil
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case time.Duration:
+		return int64(v), nil
+	case uint:
+		return unsigned(uint64(v), p)
+	case uint8:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case uint64:
+		return unsigned(v, p)
+	case float32:
+		return widen(v), nil
+	case driver.Valuer:
+		// a wrapper's value may be of another Valuer, but not forever
+		valuer := v
+		for range maxValuers {
+			// a nil pointer to a type whose method has a value receiver is NULL,
+			// as database/sql has it, rather than a panic
+			if rv := reflect.ValueOf(valuer); rv.Kind() == reflect.Pointer && rv.IsNil() &&
+				rv.Type().Elem().Implements(valuerType) {
+				return nil, nil
+			}
+			value, err := valuer.Value()
+			if err != nil {
+				return nil, err
+			}
+			next, ok := value.(driver.Valuer)
+			if !ok {
+				return convert(value, p)
+			}
+			valuer = next
+		}
+		return nil, fmt.Errorf("Value method of %T returned driver.Valuers %d deep", v, maxValuers)
+	}
+
+	// types of those kinds, declared in other packages, are taken as them,
+	// and a pointer as what it points to, or NULL if it's nil
+	switch rv := reflect.ValueOf(value); rv.Kind() {
+	case reflect.Pointer:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return convert(rv.Elem().Interface(), p)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return unsigned(rv.Uint(), p)
+	case reflect.Float32:
+		return widen(float32(rv.Float())), nil
+	case reflect.Float64:
+		return rv.Float(), nil
+	case reflect.Bool:
+		return rv.Bool(), nil
+	case reflect.String:
+		return rv.String(), nil
+	}
+	return nil, fmt.Errorf("unsupported type %T", value)
+}
+
+// f as the float64 of its shortest decimal, so that float32(0.1) is stored
+// as 0.1, not as 0.10000000149011612, which it is exactly
+func widen(f float32) float64 {
+	v, _ := strconv.ParseFloat(strconv.FormatFloat(float64(f), 'g', -1, 32), 64)
+	return v
+}
+
+// how many driver.Valuers the value of an argument may go through, each
+// the value of the last, before it's taken for a cycle
+const maxValuers = 16
+
+var valuerType = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+
+// v as an int64, or past math.MaxInt64, as p says
+func unsigned(v uint64, p Uint64Policy) (driver.Value, error) {
+	switch {
+	case v <= math.MaxInt64, p == Uint64Wrap:
+		return int64(v), nil
+	case p == Uint64Text:
+		return strconv.FormatUint(v, 10), nil
+	default:
+		return nil, fmt.Errorf("uint value %d overflows int64", v)
+	}
+}
+
+func (c *Conn) CheckNamedValue(nv *driver.NamedValue) (err error) {
+	v := nv.Value
+	if nv.Value, err = c.connector.bind(v); err != nil {
+		param := "$" + strconv.Itoa(nv.Ordinal)
+		if nv.Name != "" {
+			param = ":" + nv.Name
+		}
+		return c.connector.scrub(err, v, param)
+	}
+	return nil
+}
+
+func (s *Stmt) CheckNamedValue(nv *driver.NamedValue) error {
+	return s.conn.CheckNamedValue(nv)
+}
+
+func encode(w *bytes.Buffer, value any, c *Connector) error {
+	switch v := value.(type) {
+	case nil:
+		w.WriteString("NULL")
+	case string:
+		v, err := valid(v, c.utf8)
+		if err != nil {
+			return err
+		}
+		// sqlite3 checks whether a statement is complete at every line it
+		// reads, which takes it forever through a value of many lines,
+		// and drops the \r of each \r\n it reads; a long one is broken over lines
+		if strings.Count(v, "\n") > 64 || strings.Contains(v, "\r\n") || len(v) > base64Line {
+			w.WriteString("CAST(")
+			encodeBase64(w, []byte(v))
+			w.WriteString(" AS TEXT)")
+			break
+		}
+		// bytes that aren't UTF-8 go through as they are, since quote
+		// only doubles the quotes
+		w.WriteString(quote(v))
+	case int64:
+		w.WriteString(strconv.FormatInt(v, 10))
+	case bool:
+		if v {
+			w.WriteString("TRUE")
+		} else {
+			w.WriteString("FALSE")
+		}
+	case float64:
+		switch {
+		case !math.IsInf(v, 0) && !math.IsNaN(v):
+			w.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+		case c.float == FloatNull:
+			w.WriteString("NULL")
+		case c.float == FloatText:
+			w.WriteString(quote(strconv.FormatFloat(v, 'g', -1, 64)))
+		case c.float == FloatFail:
+			return fmt.Errorf("float value %v can't be stored", v)
+		case math.IsInf(v, 1):
+			w.WriteString("9e999") // which sqlite takes as infinity
+		case math.IsInf(v, -1):
+			w.WriteString("-9e999")
+		default:
+			w.WriteString("NULL") // a NaN, as sqlite stores it
+		}
+	case []byte:
+		encodeBase64(w, v)
+	case time.Time:
+		if c.loc != nil {
+			v = v.In(c.loc)
+		}
+		switch c.timeLayout {
+		case TimeUnix:
+			w.WriteString(strconv.FormatInt(v.Unix(), 10))
+		case TimeUnixMilli:
+			w.WriteString(strconv.FormatInt(v.UnixMilli(), 10))
+		case "":
+			w.WriteByte('\'')
+			w.WriteString(v.Format("2006-01-02 15:04:05.999999999-07:00"))
+			w.WriteByte('\'')
+		default:
+			w.WriteString(quote(v.Format(c.timeLayout)))
+		}
+	case literal:
+		w.WriteString(string(v))
+	case list:
+		for i, v := range v {
+			if i > 0 {
+				w.WriteString(", ")
+			}
+			if err := encode(w, v, c); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported type %T", v)
+	}
+	return nil
+}
+
+// how many bytes of a value are encoded on each line, as sqlite3 holds a
+// line in a buffer it grows as it reads; base64() skips the newlines, where
+// pieces joined with || would each be copied
+const base64Line = 3 << 20
+
+// b as sqlite's base64() of it, a piece to a line
+func encodeBase64(w *bytes.Buffer, b []byte) {
+	w.WriteString("base64('")
+	for {
+		n := min(len(b), base64Line)
+		enc := base64.NewEncoder(base64.StdEncoding, w)
+		enc.Write(b[:n])
+		enc.Close()
+		if b = b[n:]; len(b) == 0 {
+			break
+		}
+		w.WriteByte('\n')
+	}
+	w.WriteString("')")
+}
+
+func subst1(s *Stmt, args []driver.Value) (string, error) {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return subst2(s, named)
+}
+
+func subst2(s *Stmt, args []driver.NamedValue) (string, error) {
+	s.conn.redactor = nil
+	if l1, l2 := len(args), s.inputs; l1 != l2 {
+		return "", s.arity(l1)
+	} else if l1 == 0 {
+		return s.query, nil
+	}
+
+	buf := buffers.Get().(*bytes.Buffer)
+	defer release(buf)
+
+	c := s.conn.connector
+	var redactions []string // pairs of the text of a value and its parameter
+
+	pq := 0 // index following the previous parameter
+	for _, p := range s.params {
+		buf.WriteString(s.query[pq:p.i])
+		pq = p.i + p.n
+		param := s.query[p.i:pq]
+
+		arg, err := p.bind(args)
+		if err != nil {
+			return buf.String(), err
+		}
+		// unless database/sql has already, as when the driver is used directly
+		v, err := c.bind(arg)
+		if err != nil {
+			return buf.String(), c.scrub(err, arg, param)
+		}
+		if _, ok := v.(list); ok && !p.listed(s.query) {
+			return buf.String(), fmt.Errorf("a slice is bound to %s, not the parameter of IN (?)", param)
+		}
+		start := buf.Len()
+		if err := encode(buf, v, c); err != nil {
+			return buf.String(), c.scrub(err, arg, param)
+		}
+		if c.redact {
+			redactions = redaction(redactions, v, string(buf.Bytes()[start:]), param, c)
+		}
+	}
+
+	if pq > 0 && pq < len(s.query) {
+		buf.WriteString(s.query[pq:])
+	}
+
+	if len(redactions) > 0 {
+		s.conn.redactor = strings.NewReplacer(redactions...)
+	}
+	return buf.String(), nil
+}
+
+// pairs, and the text of v, as encoded, and its parameter, unless it's a
+// number or the like; each of the values of a list, for IN (?), on its own
+func redaction(pairs []string, v driver.Value, text, param string, c *Connector) []string {
+	switch v := v.(type) {
+	case nil, int64, float64, bool:
+		return pairs
+	case list:
+		for _, v := range v {
+			var b bytes.Buffer
+			encode(&b, v, c)
+			pairs = redaction(pairs, v, b.String(), param, c)
+		}
+		return pairs
+	}
+	if text == "" {
+		return pairs
+	}
+	return append(pairs, text, param)
+}
+
+// whether the parameter is the whole of the list of an IN, as in x IN (?)
+func (p param) listed(query string) bool {
+	const space = " \t\r\n\f"
+	before := strings.TrimRight(query[:p.i], space)
+	after := strings.TrimLeft(query[p.i+p.n:], space)
+	if !strings.HasSuffix(before, "(") || !strings.HasPrefix(after, ")") {
+		return false
+	}
+	before = strings.TrimRight(before[:len(before)-1], space)
+	if n := len(before); n < 2 || !strings.EqualFold(before[n-2:], "IN") {
+		return false
+	} else if n > 2 {
+		c := before[n-3]
+		return !(c == '_' || c == '$' || c >= 0x80 ||
+			c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9')
+	}
+	return true
+}
+
+// ArityError is a statement given more or fewer arguments than its
+// query has parameters. With too few, it points at those without any.
+type ArityError struct {
+	Args, Params int      // how many arguments there were, and parameters
+	Query        string   // as written, maybe with a semicolon added
+	Statement    int      // index of the statement of the first parameter without an argument, -1 if none is
+	Statements   int      // of the query, not counting empty ones
+	Missing      []string // the parameters without arguments, as written
+	Offsets      []int    // in bytes, into the query, of each of Missing
+}
+
+func (e *ArityError) Error() string {
+	s := fmt.Sprintf("got %d args but have %d parameters in the query", e.Args, e.Params)
+	if len(e.Offsets) == 0 {
+		return s + ": " + e.Query
+	}
+
+	// the line of the first, with a caret under each of those on it
+	first := e.Offsets[0]
+	start := strings.LastIndexByte(e.Query[:first], '\n') + 1
+	end := strings.IndexByte(e.Query[first:], '\n')
+	if end < 0 {
+		end = len(e.Query)
+	} else {
+		end += first
+	}
+	var carets []byte
+	p := start
+	for _, at := range e.Offsets {
+		if at >= end {
+			break
+		}
+		for _, c := range e.Query[p:at] {
+			if c == '\t' {
+				carets = append(carets, '\t')
 			} else {
-				n++
-				break
-			}
-			switch c {
-			case ',':
-				dest[i] = nil
-				i++
-				n = 0
-				r.s = NONE
-			case '\n':
-				dest[i] = nil
-				i++
-				n = 0
-				r.s = EOR
+				carets = append(carets, ' ')
 			}
-		case ERR:
-			var token string
-			switch r.s & (^ERR) {
-			case PARSE:
-				token = "Parse error"
-			case RUNTIME:
-				token = "Runtime error"
-			case 0:
-				token = "Error"
-			default:
-				return handle("unexpected error condition")
+		}
+		carets = append(carets, '^')
+		p = at + 1 // past the prefix of the parameter
+	}
+	line := strings.Count(e.Query[:first], "\n") + 1
+
+	return fmt.Sprintf("%s: no argument for %s (statement %d of %d, line %d):\n\t%s\n\t%s",
+		s, strings.Join(e.Missing, ", "), e.Statement+1, e.Statements, line,
+		strings.TrimRight(e.Query[start:end], "\r"), carets)
+}
+
+// the error for n arguments, not as many as the parameters
+func (s *Stmt) arity(n int) error {
+	e := &ArityError{Args: n, Params: s.inputs, Query: s.query, Statement: -1, Statements: len(s.statements())}
+	for _, p := range s.params {
+		if p.index <= n {
+			continue
+		}
+		if e.Statement < 0 {
+			e.Statement = p.stmt
+		}
+		e.Missing = append(e.Missing, s.query[p.i:p.i+p.n])
+		e.Offsets = append(e.Offsets, p.i)
+	}
+	return e
+}
+
+// the statements of the query, but empty ones, without their semicolons
+func (s *Stmt) statements() []string {
+	var stmts []string
+	p := 0
+	for _, i := range s.semicolons {
+		if stmt := s.query[p:i]; len(tokenize(stmt)) > 0 {
+			stmts = append(stmts, strings.TrimSpace(stmt))
+		}
+		p = i + 1
+	}
+	return stmts
+}
+
+// find the argument for the parameter, by name if it has one, otherwise by position
+func (p param) bind(args []driver.NamedValue) (any, error) {
+	if p.name != "" {
+		for _, arg := range args {
+			if arg.Name == p.name[1:] {
+				return arg.Value, nil
 			}
-			if n >= len(token) {
-				// no-op
-			} else if c != token[n] {
-				return handle("unexpected error token")
-			} else {
-				n++
+		}
+	}
+
+	for _, arg := range args {
+		if arg.Name == "" && arg.Ordinal == p.index {
+			return arg.Value, nil
+		}
+	}
+
+	if p.name != "" {
+		return nil, fmt.Errorf("missing argument for parameter %s", p.name)
+	}
+	return nil, fmt.Errorf("missing argument for parameter %d", p.index)
+}
+
+// BindNamed gives the named arguments of the :name, @name and $name
+// parameters of query, from v: a map from names to values, each of which
+// one of them must take, or a struct, or a pointer to one, whose fields are
+// taken by the name of their db tag, or by their own name, in any case.
+// A parameter without a value is an error; ? and ?NNN are left to the caller.
+//
+//	args, err := sqlite3.BindNamed(query, map[string]any{"id": 1})
+//	db.Exec(query, args...)
+func BindNamed(query string, v any) ([]any, error) {
+	var names, params []string // without & with their prefixes
+	for _, p := range (*Conn)(nil).prepare(query).params {
+		if p.name != "" && !slices.Contains(names, p.name[1:]) {
+			names = append(names, p.name[1:])
+			params = append(params, p.name)
+		}
+	}
+
+	var lookup func(name string) (any, bool)
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	switch {
+	case rv.Kind() == reflect.Map && rv.Type().Key().Kind() == reflect.String:
+		for _, k := range rv.MapKeys() {
+			if !slices.Contains(names, k.String()) {
+				return nil, fmt.Errorf("no parameter of the query for %q", k.String())
 			}
-			switch c {
-			case '\n':
-				r.cancel()
-				return fmt.Errorf("%s", r.str.String())
-			default:
-				r.str.WriteByte(c)
+		}
+		lookup = func(name string) (any, bool) {
+			e := rv.MapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()))
+			if !e.IsValid() {
+				return nil, false
 			}
-		case STRING | ESCAPED:
-			switch c {
-			case '\'':
-				r.str.WriteByte(c)
-				r.s &= ^ESCAPED
-			case ',':
-				r.s = NONE
-				s := r.str.String()
-				r.str.Reset()
-				if r.n == 0 {
-					r.names = append(r.names, s)
-					break
-				}
-				dest[i] = s
-				i++
-			case '\n':
-				r.s = EOR
-				s := r.str.String()
-				r.str.Reset()
-				if r.n == 0 {
-					r.names = append(r.names, s)
-					break
-				} else {
-					dest[i] = s
-				}
-				i++
-			default:
-				return handle(fmt.Sprintf("unexpected character: %c", c))
+			return e.Interface(), true
+		}
+	case rv.Kind() == reflect.Struct:
+		fields := make(map[string]any)
+		for _, f := range reflect.VisibleFields(rv.Type()) {
+			tag, _, _ := strings.Cut(f.Tag.Get("db"), ",")
+			if !f.IsExported() || f.Anonymous || tag == "-" {
+				continue
 			}
-		case STRING:
-			switch c {
-			case '\'':
-				r.s |= ESCAPED
-			default:
-				r.str.WriteByte(c)
+			if tag == "" {
+				tag = strings.ToLower(f.Name)
 			}
-		case NUMERIC:
-			switch c {
-			case '\n':
-				dest[i] = n
-				i++
-				r.s = EOR
-			case ',':
-				dest[i] = n
-				i++
-				r.s = NONE
-			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-				if n > 0 || n == 0 {
-					n = (n * 10) + int(c-'0')
-				} else {
-					n = (n * 10) - int(c-'0')
-				}
-			case '.':
-				r.s = DECIMAL
-			default:
-				return handle("expecting decimal, comma or white space")
+			if _, ok := fields[tag]; !ok {
+				fields[tag] = rv.FieldByIndex(f.Index).Interface()
 			}
-		case E:
-			switch c {
-			case '-':
-				e = -0
-				r.s = EXPONENT
-			case '+':
-				e = 0
-				r.s = EXPONENT
-			default:
-				return handle("expecting sign")
+		}
+		lookup = func(name string) (any, bool) {
+			if v, ok := fields[name]; ok {
+				return v, true
 			}
-		case EXPONENT:
-			switch c {
-			case '\n':
-				r.s = EOR
-				dest[i] = float64(n) * math.Pow10(e-d)
-				i++
-				e = 0
-			case ',':
-				dest[i] = float64(n) * math.Pow10(e-d)
-				i++
-				e = 0
-				r.s = NONE
-			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-				if e < 0 || e == -0 {
-					e = (e * 10) - int(c-'0')
-				} else {
-					e = (e * 10) + int(c-'0')
-				}
-			default:
-				return handle("expecting numbers, white space or comma")
+			v, ok := fields[strings.ToLower(name)]
+			return v, ok
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type %T, not a map of strings or a struct", v)
+	}
+
+	args := make([]any, len(names))
+	for i, name := range names {
+		v, ok := lookup(name)
+		if !ok {
+			return nil, fmt.Errorf("missing argument for parameter %s", params[i])
+		}
+		args[i] = sql.Named(name, v)
+	}
+	return args, nil
+}
+
+func hasPrefixes(needle string, haystack ...string) bool {
+	for _, h := range haystack {
+		if strings.HasPrefix(needle, h) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(s, substr string) bool {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		if strings.EqualFold(s[i:i+len(substr)], substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Stmt) Exec(args []driver.Value) (driver.Result, error) {
+	if err := s.err(); err != nil {
+		return nil, err
+	}
+
+	query, err := subst1(s, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.exec(context.Background(), query)
+}
+
+func (s *Stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if err := s.err(); err != nil {
+		return nil, err
+	}
+
+	query, err := subst2(s, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.exec(ctx, query)
+}
+
+func (s *Stmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := s.err(); err != nil {
+		return nil, err
+	}
+
+	query, err := subst1(s, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.queryRows(context.Background(), query)
+}
+
+func (s *Stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if err := s.err(); err != nil {
+		return nil, err
+	}
+
+	query, err := subst2(s, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.queryRows(ctx, query)
+}
+
+// the query, with a separator printed between the output of each statement,
+// and those statements, with "" for each that isn't a query
+func (s *Stmt) separated() (string, []string) {
+	var buf strings.Builder
+	var stmts []string
+	p := 0
+	for _, i := range s.semicolons {
+		// but those of nothing, or of only comments
+		if stmt := s.query[p : i+1]; len(tokenize(stmt)) > 1 {
+			if buf.Len() > 0 {
+				buf.WriteString("\n.print \"#\"\n")
 			}
-		case DECIMAL:
-			switch c {
-			case '\n':
-				dest[i] = float64(n) * math.Pow10(e-d)
-				i++
-				r.s = EOR
-			case ',':
-				dest[i] = float64(n) * math.Pow10(e-d)
-				i++
-				r.s = NONE
-			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-				d++
-				if n > 0 || n == 0 {
-					n = (n * 10) + int(c-'0')
-				} else {
-					n = (n * 10) - int(c-'0')
-				}
-			case 'e':
-				r.s = E
+			buf.WriteString(stmt)
+			if !selects(stmt) {
+				stmt = ""
 			}
+			stmts = append(stmts, stmt)
 		}
-		r.i++
+		p = i + 1
+	}
+	return buf.String(), stmts
+}
+
+// the probe of the header of stmt, a query, as sqlite3 only prints the header
+// with the first row; its rows are left out without it being run, leaving
+// the row of NULLs of the join
+func probing(stmt string) string {
+	return "SELECT q.* FROM (SELECT 1) LEFT JOIN (SELECT * FROM (\n" +
+		strings.TrimSuffix(strings.TrimSpace(stmt), ";") + "\n) LIMIT 0) AS q;"
+}
+
+// around the statements of a query with QualifiedNames
+const (
+	qualify   = "PRAGMA short_column_names = 0;\nPRAGMA full_column_names = 1;\n"
+	unqualify = "\nPRAGMA full_column_names = 0;\nPRAGMA short_column_names = 1;\n"
+)
+
+// the names of the columns of each of the queries of query, as sqlite3 names
+// them by default, from the probes of their headers; nil if it fails
+func (c *Conn) unqualified(query string) [][]string {
+	s := c.prepare(query)
+	var probes []string
+	p := 0
+	for _, i := range s.semicolons {
+		if stmt := s.query[p : i+1]; selects(stmt) {
+			probes = append(probes, probing(stmt))
+		}
+		p = i + 1
+	}
+	if probes == nil {
+		return nil
+	}
+
+	rows, err := c.query(context.Background(), strings.Join(probes, "\n.print \"#\"\n"))
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var names [][]string
+	for {
+		names = append(names, unrenamed(rows.header))
+		if err := rows.NextResultSet(); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil
+		}
+	}
+	if len(names) != len(probes) {
+		return nil
+	}
+	return names
+}
+
+// keep the header as qualified, and give the names without qualifiers
+// in its place, as the probe of the result set's query, statement n, has them
+func (r *Rows) unqualify(n int) {
+	r.qualified = r.header
+	queries := 0
+	for _, stmt := range r.stmts[:min(n, len(r.stmts))] {
+		if stmt != "" {
+			queries++
+		}
+	}
+	if queries < len(r.names) && len(r.names[queries]) == len(r.header) {
+		r.header = r.names[queries]
+	}
+}
+
+// the header of statement n, a query which printed no rows, from its probe,
+// once the rest of the output is in, which the probe's comes after; nil
+// if the statement isn't a query
+func (r *Rows) probeHeader(n int) ([]string, error) {
+	if n >= len(r.stmts) || r.stmts[n] == "" {
+		return nil, nil
+	}
+
+	rest := append([]byte(nil), r.buf[r.i:]...)
+	for more := true; more; {
+		select {
+		case buf, ok := <-r.ch:
+			rest = append(rest, buf...)
+			more = ok
+		case <-r.conn.pipeline.Done():
+			return nil, ErrExited
+		case <-r.ctx.Done():
+			return nil, r.ctx.Err()
+		}
+	}
+	r.taken += r.i
+	r.buf, r.i = rest, 0
+
+	probe, err := r.conn.query(r.ctx, probing(r.stmts[n]))
+	if err != nil {
+		return nil, err
+	}
+	defer probe.Close()
+	header := unrenamed(probe.header)
+	if r.qualifies {
+		r.qualified = header
+	}
+	return header, nil
+}
+
+// whether stmt is a query, a SELECT or VALUES, maybe after a WITH clause
+func selects(stmt string) bool {
+	depth := 0
+	for i, t := range tokenize(stmt) {
+		switch {
+		case t == "(":
+			depth++
+		case t == ")":
+			depth--
+		case depth > 0:
+		case strings.EqualFold(t, "SELECT"), strings.EqualFold(t, "VALUES"):
+			return true
+		case i == 0 && !strings.EqualFold(t, "WITH"):
+			return false
+		case slices.Contains([]string{"INSERT", "REPLACE", "UPDATE", "DELETE"}, strings.ToUpper(t)):
+			return false
+		}
+	}
+	return false
+}
+
+func (s *Stmt) err() error {
+	if s.closed {
+		return fmt.Errorf("statement is closed")
+	}
+	return nil
+}
+
+// the context of one execution, which ends with
+// the timeout option, or when the statement is closed
+func (s *Stmt) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	var cancel context.CancelFunc
+	if s.opts.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.opts.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running == nil {
+		s.running = make(map[*context.CancelFunc]struct{})
 	}
+	s.running[&cancel] = struct{}{}
 
-	r.s = NONE
-	r.n++
-	return
+	return ctx, func() {
+		s.mu.Lock()
+		delete(s.running, &cancel)
+		s.mu.Unlock()
+		cancel()
+	}
 }
 
-func encode(w *strings.Builder, value any) error {
-	switch v := value.(type) {
-	case nil:
-		w.WriteString("NULL")
-	case string:
-		w.WriteByte('\'')
-		for _, c := range v {
-			if c == '\'' {
-				w.WriteRune('\'')
+// run the substituted query under the statement's options
+func (s *Stmt) exec(ctx context.Context, query string) (*Result, error) {
+	if s.syntax != nil {
+		return nil, s.syntax
+	}
+	ctx, cancel := s.context(ctx)
+	defer cancel()
+	ctx = from(ctx, s.query, 0)
+
+	if !(s.opts.Bail || s.opts.BailOn) || len(s.semicolons) < 2 {
+		return retry(s.conn, ctx, query, func() (*Result, error) {
+			if s.returning {
+				return s.conn.execReturning(ctx, query)
 			}
-			w.WriteRune(c)
-		}
-		w.WriteByte('\'')
-	case int64:
-		w.WriteString(strconv.FormatInt(v, 10))
-	case bool:
-		if v {
-			w.WriteString("TRUE")
-		} else {
-			w.WriteString("FALSE")
+			return s.conn.exec(ctx, query)
+		})
+	}
+
+	if s.opts.BailOn && !s.returning && s.conn.tx == nil && s.conn.lease == nil {
+		return s.bail(ctx, query)
+	}
+
+	// one statement at a time, stopping at the first error
+	var r *Result
+	var err error
+	all := s.conn.prepare(query)
+	p, n := 0, 0 // n - statements before the part, but empty ones
+	for _, i := range all.semicolons {
+		part := s.conn.prepare(all.query[p : i+1])
+		ctx := context.WithValue(ctx, sourceKey{}, source{s.query, n})
+		if r, err = part.exec(ctx, part.query); err != nil {
+			break
 		}
-	case float64:
-		w.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
-	case []byte:
-		w.WriteString("base64('" + base64.StdEncoding.EncodeToString(v) + "')")
-	case time.Time:
-		w.WriteByte('\'')
-		w.WriteString(v.Format("2006-01-02 15:04:05.999999999-07:00"))
-		w.WriteByte('\'')
-	default:
-		return fmt.Errorf("unsupported type %T", v)
+		n += len(ends(part.query))
+		p = i + 1
 	}
-	return nil
+	return r, err
 }
 
-func subst1(s *Stmt, args []driver.Value) (string, error) {
-	if l1, l2 := len(args), len(s.questions); l1 != l2 {
-		return "", fmt.Errorf("got %d args but have %d question marks in the query: %s", l1, l2, s.query)
-	} else if l1 == 0 {
-		return s.query, nil
+// run the statements in one go under .bail on, which has sqlite3 exit at the
+// first failing statement rather than go on to the rest. The error says which
+// statement it was, and the conn is replaced, or restarted WithRestart, as
+// there's no other way to have sqlite3 skip the rest of what it was given.
+// That would lose a transaction or a shared child's database, so within
+// either, the statements are run one at a time, as with Bail.
+func (s *Stmt) bail(ctx context.Context, query string) (*Result, error) {
+	r, out, err := s.conn.run(ctx, ".bail on\n"+query+"\n.bail off", true)
+	if err != ErrExited {
+		return r, err
 	}
 
-	var buf strings.Builder
-	buf.Grow(64)
-	pq := 0 // index of previous question mark
-	for i := 0; i < len(args); i++ {
-		buf.WriteString(s.query[pq:s.questions[i]])
-		pq = s.questions[i] + 1
-		if err := encode(&buf, args[i]); err != nil {
-			return buf.String(), err
+	// the error is the last thing sqlite3 printed, but for the lines
+	// pointing out where a parse error is
+	var last string
+	for _, line := range strings.Split(string(out), "\n") {
+		if hasPrefixes(line, "Error", "Runtime error", "Parse error", "line ") {
+			last = line
 		}
 	}
+	if last == "" {
+		return r, err
+	}
+	return r, r.error(last)
+}
 
-	if pq > 0 && pq < len(s.query) {
-		buf.WriteString(s.query[pq:])
+func (s *Stmt) queryRows(ctx context.Context, query string) (*Rows, error) {
+	if s.syntax != nil {
+		return nil, s.syntax
+	}
+	ctx, cancel := s.context(ctx)
+	ctx = from(ctx, s.query, 0)
+	r, err := retry(s.conn, ctx, query, func() (*Rows, error) {
+		opts := s.opts
+		opts.JSON = opts.JSON || s.conn.connector.json
+		opts.RawText = opts.RawText || s.conn.connector.rawText
+		opts.ParseTime = opts.ParseTime || s.conn.connector.parseTime
+		opts.Booleans = opts.Booleans || s.conn.connector.bools
+		opts.RawJSON = opts.RawJSON || s.conn.connector.rawJSON
+		opts.decode = s.conn.connector.decoders != nil
+		opts.headers = true
+		return s.conn.rows(ctx, query, opts)
+	})
+	if err != nil {
+		cancel()
+		return nil, err
 	}
 
-	return buf.String(), nil
+	stop := r.cancel
+	r.cancel = func() {
+		stop()
+		cancel()
+	}
+	return r, nil
 }
 
-func subst2(s *Stmt, args []driver.NamedValue) (string, error) {
-	if l1, l2 := len(args), len(s.questions); l1 != l2 {
-		return "", fmt.Errorf("got %d args but have %d question marks in the query: %s", l1, l2, s.query)
-	} else if l1 == 0 {
-		return s.query, nil
+// run f, and again as the connector's retry policy allows
+// while it fails because the database is busy or locked
+func retry[T any](c *Conn, ctx context.Context, query string, f func() (T, error)) (T, error) {
+	p := c.connector.retry
+	v, err := f()
+	if p.Attempts < 2 || c.tx != nil || statements(query) != 1 {
+		return v, err
 	}
 
-	var buf strings.Builder
-	buf.Grow(64)
-	pq := 0 // index of previous question mark
-	for i := 0; i < len(args); i++ {
-		buf.WriteString(s.query[pq:s.questions[i]])
-		pq = s.questions[i] + 1
-		if err := encode(&buf, args[i].Value); err != nil {
-			return buf.String(), err
+	backoff := p.Backoff
+	for attempt := 1; attempt < p.Attempts && (IsBusy(err) || IsLocked(err)); attempt++ {
+		d := backoff + time.Duration((mrand.Float64()*2-1)*p.Jitter*float64(backoff))
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return v, err
 		}
-	}
 
-	if pq > 0 && pq < len(s.query) {
-		buf.WriteString(s.query[pq:])
+		v, err = f()
+		if backoff *= 2; p.Max > 0 && backoff > p.Max {
+			backoff = p.Max
+		}
 	}
+	return v, err
+}
 
-	return buf.String(), nil
+// number of statements in query, not counting empty ones
+func statements(query string) int {
+	n := 0
+	empty := true
+	var b body
+	for _, t := range tokenize(query) {
+		if t != ";" {
+			b.word(t)
+		}
+		if t == ";" && b.end() {
+			empty = true
+		} else if t != ";" && empty {
+			empty = false
+			n++
+		}
+	}
+	return n
 }
 
-// dynamic buffered channel
-func buffer[T any](ctx context.Context, input, output chan T) {
-	b := make([]T, 0, 8)
+// hand the query to the control routine, which has taken the job.
+// false means the child was already gone, so the query never reached it.
+func (c *Conn) deliver(j *job, query string) bool {
+	select {
+	case <-c.pipeline.Done():
+		j.in <- nil // the control routine is waiting on it regardless
+		return false
+	default:
+	}
 
-	var t T
-	var out chan T = output
+	// control follows the query with a newline and the .print line
+	j.input, j.line = query, c.owner.lines+1
+	c.owner.lines += strings.Count(query, "\n") + 2
 
-loop:
-	for open := true; open || len(b) > 0; {
-		if len(b) == 0 {
-			out = nil
-		} else {
-			out = output
-			t = b[0]
-		}
+	j.in <- []byte(query)
+	return true
+}
+
+// the cause of a query's context ending once the call is over,
+// which is no reason to interrupt the child
+var errReturned = errors.New("sqlite3: call returned")
+
+// kill the child if ctx is cancelled or its deadline passes before the
+// job is done, so the statement stops rather than running on unheard.
+// sqlite3 exits once interrupted, but only notices when it next reads
+// input, which it may be waiting on already, so it isn't interrupted.
+// This isn't done to a shared child, whose in-memory database would go
+// with it; other conns are marked bad straight away, for the pool to
+// replace rather than hand out with a child that's on its way out.
+func (c *Conn) enforce(ctx context.Context, done <-chan struct{}) {
+	if c.lease != nil {
+		return
+	}
 
+	// the conn's child is replaced once it exits, when the conn respawns
+	exited, proc := c.pipeline.Done(), c.cmd.Process
+	go func() {
 		select {
-		case t, open = <-input:
-			if open {
-				b = append(b, t)
-			} else {
-				input = nil
-			}
-		case out <- t:
-			b = b[1:]
 		case <-ctx.Done():
-			break loop
+		case <-done:
+			return
+		case <-exited:
+			return
+		}
+
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if context.Cause(ctx) != errReturned {
+			c.killed.Store(true)
+			proc.Kill()
 		}
+	}()
+}
 
+// act on the child as the watchdog says if it's silent too long before the job is done
+func (c *Conn) watch(query string, done <-chan struct{}) {
+	w := c.connector.watchdog
+	if w.Timeout <= 0 {
+		return
 	}
-	close(output)
+	owner, since := c.owner, time.Now()
 
-	return
+	go func() {
+		t := time.NewTimer(w.Timeout)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+			case <-done:
+				return
+			case <-owner.pipeline.Done():
+				return
+			}
+
+			// the query's own output, not the last one's
+			heard := time.Unix(0, owner.heard.Load())
+			if heard.Before(since) {
+				heard = since
+			}
+			if silent := time.Since(heard); silent < w.Timeout {
+				t.Reset(w.Timeout - silent)
+				continue
+			}
+
+			pid := owner.cmd.Process.Pid
+			log.Printf("sqlite3: child %d has printed nothing for %s, running: %.200q", pid, w.Timeout, query)
+			switch w.Action {
+			case WatchdogQuit:
+				owner.cmd.Process.Signal(syscall.SIGQUIT)
+			case WatchdogKill:
+				owner.cmd.Process.Kill()
+			}
+			return
+		}
+	}()
 }
 
-func hasPrefixes(needle string, haystack ...string) bool {
-	for _, h := range haystack {
-		if strings.HasPrefix(needle, h) {
-			return true
+func (c *Conn) exec(ctx context.Context, query string) (*Result, error) {
+	r, _, err := c.run(ctx, spread(query), false)
+	return r, err
+}
+
+// query with each statement on a line of its own: sqlite3 flushes its output
+// before reading a line, so the error of a statement then starts a line,
+// rather than breaking into the rows of one before it
+func spread(query string) string {
+	semicolons := ends(query)
+	if len(semicolons) < 2 {
+		return query
+	}
+
+	var b strings.Builder
+	p := 0
+	for _, i := range semicolons {
+		b.WriteString(query[p : i+1])
+		if p = i + 1; p < len(query) && query[p] != '\n' {
+			b.WriteByte('\n')
 		}
 	}
-	return false
+	b.WriteString(query[p:])
+	return b.String()
 }
 
-func (s *Stmt) Exec(args []driver.Value) (driver.Result, error) {
-	var query string
-	var err error
+// like exec, but with all set, the output is read to the end and
+// returned, rather than looked at for an error
+func (c *Conn) run(ctx context.Context, query string, all bool) (*Result, []byte, error) {
 	var r Result
 
-	if query, err = subst1(s, args); err != nil {
-		return nil, err
+	if err := c.restart(ctx); err != nil {
+		return nil, nil, err
 	}
+	c.begun = c.begun || begins(query)
+
+	ctx, finish := context.WithCancelCause(ctx)
+	defer finish(errReturned)
 
-	r.ctx, r.cancel = context.WithCancel(context.Background())
-	r.conn = s.conn
+	r.ctx, r.cancel = context.WithCancel(ctx)
+	r.conn = c
+	r.in = make(chan []byte)
 	r.ch = make(chan []byte)
+	r.done = make(chan struct{})
+	r.source, _ = ctx.Value(sourceKey{}).(source)
+	r.redact = c.redactor
+
+	if err := c.acquire(r.ctx); err != nil {
+		return nil, nil, err
+	}
 
 	select {
-	case s.conn.ctl <- r.job:
+	case c.ctl <- r.job:
+		c.busy = r.done
+		defer c.release(r.done)
 	case <-r.ctx.Done():
-		return nil, r.ctx.Err()
-	case <-s.conn.pipeline.Done():
-		return nil, driver.ErrBadConn
+		c.release(nil)
+		return nil, nil, r.ctx.Err()
+	case <-c.pipeline.Done():
+		c.release(nil)
+		return nil, nil, driver.ErrBadConn
 	}
 
-	if locker := s.conn.connector.locker; locker != nil {
+	if locker := c.connector.locker; locker != nil {
 		locker.Lock()
 		defer locker.Unlock()
 	}
 
-	r.ch <- []byte(query)
+	if !c.deliver(&r.job, query) {
+		return nil, nil, driver.ErrBadConn
+	}
+	c.enforce(ctx, r.done)
+	c.watch(r.redacted(query), r.done)
+
+	if all {
+		var out []byte
+		exited := c.pipeline.Done()
+		var gone <-chan struct{}
+		for {
+			select {
+			case s, ok := <-r.ch:
+				if !ok {
+					r.cancel()
+					return &r, out, nil
+				}
+				out = append(out, s...)
+			case <-r.ctx.Done():
+				return &r, out, r.ctx.Err()
+			case <-exited:
+				// the reader may not have passed on the last of the output
+				exited, gone = nil, c.owner.Done()
+			case <-gone:
+				return &r, out, ErrExited
+			}
+		}
+	}
+
+	// an error may follow whatever rows the statements before it printed
+	var lines errorLines
+	for {
+		select {
+		case s, ok := <-r.ch:
+			if !ok {
+				r.cancel()
+				return &r, nil, nil
+			}
+			if line, ok := lines.feed(s); ok {
+				r.cancel()
+				return &r, nil, r.error(line)
+			}
+		case <-r.ctx.Done():
+			return &r, nil, r.ctx.Err()
+		case <-c.pipeline.Done():
+			return &r, nil, ErrExited
+		}
+	}
+}
+
+// the first error line of output read a chunk at a time; sqlite3 prints
+// its errors where the rows go, but in quote mode, no row begins like one
+type errorLines struct {
+	quoted bool   // within a string of a row
+	begun  bool   // past the start of a line
+	maybe  bool   // the line may be an error
+	line   []byte // so far, while it may be
+}
 
-	select {
-	case s, ok := <-r.ch:
-		r.cancel()
-		if s := string(s); ok && hasPrefixes(s, "Error", "Runtime error", "Parse error") {
-			return &r, fmt.Errorf("%s", string(s))
+// the error line, once b ends it
+func (e *errorLines) feed(b []byte) (string, bool) {
+	for _, c := range b {
+		if !e.begun {
+			e.begun, e.maybe, e.line = true, !e.quoted, e.line[:0]
+		}
+		if e.maybe {
+			e.line = append(e.line, c)
+			if (len(e.line) == len("Runtime error") || c == '\n') &&
+				!hasPrefixes(string(e.line), "Error", "Runtime error", "Parse error", "line ") {
+				e.maybe = false
+			}
+		}
+
+		switch c {
+		case '\'':
+			e.quoted = !e.quoted
+		case '\n':
+			e.begun = false
+			if e.maybe {
+				return string(e.line), true
+			}
 		}
-		return &r, nil
-	case <-r.ctx.Done():
-		return &r, r.ctx.Err()
-	case <-s.conn.pipeline.Done():
-		return &r, driver.ErrBadConn
 	}
+	return "", false
 }
 
-func (s *Stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
-	var query string
-	var err error
-	var r Result
+// BatchResult is what came of one statement of a Batch
+type BatchResult struct {
+	Query        string
+	RowsAffected int64 // by the statement, and the triggers it set off
+	Err          error // what it failed with, nil if it didn't
+	Ran          bool  // false if an earlier statement's error stopped the batch first
+}
 
-	if query, err = subst2(s, args); err != nil {
-		return nil, err
+// Batch runs each of queries, one statement each, and reports on each of
+// them. They're written in one go, and all of them run whatever fails, unless
+// stop is set; then they stop at the first error, which has them written one
+// at a time, since sqlite3 can't be told to skip the rest of its input.
+// Rows the statements produce are discarded. The error is for the batch as a
+// whole, as when ctx is done, in which case the results are incomplete.
+func (c *Conn) Batch(ctx context.Context, queries []string, stop bool) ([]BatchResult, error) {
+	results := make([]BatchResult, len(queries))
+	for i, query := range queries {
+		results[i].Query = query
 	}
 
-	r.ctx, r.cancel = context.WithCancel(ctx)
-	r.conn = s.conn
-	r.ch = make(chan []byte)
+	if !stop {
+		return results, c.batch(ctx, results)
+	}
 
-	select {
-	case s.conn.ctl <- r.job:
-	case <-r.ctx.Done():
-		return nil, r.ctx.Err()
-	case <-s.conn.pipeline.Done():
-		return nil, driver.ErrBadConn
+	for i := range results {
+		if err := c.batch(ctx, results[i:i+1]); err != nil {
+			return results, err
+		} else if results[i].Err != nil {
+			break
+		}
 	}
+	return results, nil
+}
 
-	if locker := s.conn.connector.locker; locker != nil {
-		locker.Lock()
-		defer locker.Unlock()
+// ExecBatch is Conn.Batch, on a connection of db
+func ExecBatch(ctx context.Context, db *sql.DB, queries []string, stop bool) (results []BatchResult, err error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
 	}
+	defer conn.Close()
 
-	r.ch <- []byte(query)
+	err = conn.Raw(func(dc any) error {
+		c, ok := dc.(*Conn)
+		if !ok {
+			return fmt.Errorf("not a connection of this driver: %T", dc)
+		}
+		results, err = c.Batch(ctx, queries, stop)
+		return err
+	})
+	return results, err
+}
 
-	select {
-	case s, ok := <-r.ch:
-		r.cancel()
-		if s := string(s); ok && hasPrefixes(s, "Error", "Runtime error", "Parse error") {
-			return &r, fmt.Errorf("%s", string(s))
+// run the statements of results in one write, filling in the results
+func (c *Conn) batch(ctx context.Context, results []BatchResult) error {
+	// .changes prints the running total of changes after each statement,
+	// the first of which only gives what it was before the batch
+	var buf strings.Builder
+	buf.WriteString(".changes on\nSELECT 0 WHERE 0;\n.print \"#\"\n")
+	for _, r := range results {
+		buf.WriteString(r.Query)
+		buf.WriteString("\n;\n.print \"#\"\n")
+	}
+	buf.WriteString(".changes off")
+
+	_, out, err := c.run(ctx, buf.String(), true)
+	if err != nil {
+		return err
+	}
+
+	// quote mode prints no lines like these, and # ends each statement's output
+	var total int64
+	i := -1
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		switch {
+		case line == "#":
+			i++
+		case i >= len(results):
+		case strings.HasPrefix(line, "changes: "):
+			f := strings.Fields(line)
+			if len(f) != 4 {
+				break
+			}
+			n, err := strconv.ParseInt(f[3], 10, 64)
+			if err != nil {
+				break
+			}
+			if i >= 0 {
+				results[i].RowsAffected = n - total
+			}
+			total = n
+		case i >= 0 && hasPrefixes(line, "Error", "Runtime error", "Parse error", "line "):
+			if results[i].Err == nil {
+				e := newError(line, "", 0)
+				e.Query = results[i].Query
+				e.locate(e.Query, 0)
+				results[i].Err = e
+			}
 		}
-		return &r, nil
-	case <-r.ctx.Done():
-		return &r, r.ctx.Err()
-	case <-s.conn.pipeline.Done():
-		return &r, driver.ErrBadConn
 	}
-}
 
-func (s *Stmt) Query(args []driver.Value) (driver.Rows, error) {
-	var query string
-	var err error
-	var r Rows
+	for i := range results {
+		results[i].Ran = true
+	}
+	return nil
+}
 
-	if query, err = subst1(s, args); err != nil {
+// like exec, but parses the rows of a RETURNING clause into the Result
+func (c *Conn) execReturning(ctx context.Context, query string) (*Result, error) {
+	// the rowid of the last insert, in the same go, as a result set of its
+	// own; it's the only one if nothing was returned
+	rows, err := c.query(ctx, query+"\n.print \"#\"\nSELECT last_insert_rowid() AS \""+lastID+"\";")
+	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	r.ctx, r.cancel = context.WithCancel(context.Background())
-	r.conn = s.conn
-	r.ch = make(chan []byte)
+	r := &rows.Result
+	r.rows = [][]driver.Value{}
 
-	select {
-	case s.conn.ctl <- r.job:
-	case <-r.ctx.Done():
-		return nil, r.ctx.Err()
-	case <-s.conn.pipeline.Done():
-		return nil, driver.ErrBadConn
+	if !slices.Equal(rows.header, []string{lastID}) {
+		r.names = rows.header
+		for {
+			dest := make([]driver.Value, len(rows.header))
+			if err = rows.Next(dest); err != nil {
+				break
+			}
+			// unlike Next's, these are kept
+			for i, v := range dest {
+				if b, ok := v.([]byte); ok {
+					dest[i] = bytes.Clone(b)
+				}
+			}
+			r.rows = append(r.rows, dest)
+		}
+		if err != io.EOF {
+			return r, err
+		}
+		if err = rows.NextResultSet(); err != nil {
+			return r, err
+		}
 	}
 
-	if locker := s.conn.connector.locker; locker != nil {
-		locker.RLock()
-		defer locker.RUnlock()
+	id := make([]driver.Value, 1)
+	if err = rows.Next(id); err != nil {
+		return r, err
 	}
+	if v, ok := id[0].(int64); ok {
+		r.id = &v
+	}
+	return r, nil
+}
 
-	r.ch <- []byte(query)
+// the column of last_insert_rowid() after a RETURNING clause
+const lastID = "-last_insert_rowid-"
 
-	ch := make(chan []byte)
-	go buffer(r.ctx, r.ch, ch)
-	r.ch = ch
+// ExecReturning runs a statement, keeping any rows produced by its RETURNING clause
+func (c *Conn) ExecReturning(ctx context.Context, query string, args []driver.NamedValue) (*Result, error) {
+	s := c.prepare(query)
+	if s.syntax != nil {
+		return nil, s.syntax
+	}
 
-	switch err := r.Next(nil); err {
-	case nil, io.EOF:
-		return &r, nil
-	case io.ErrUnexpectedEOF, context.Canceled, context.DeadlineExceeded:
-		return &r, err
-	default:
-		panic(err)
+	query, err := subst2(s, args)
+	if err != nil {
+		return nil, err
 	}
+
+	return c.execReturning(ctx, query)
 }
 
-func (s *Stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
-	var query string
-	var err error
+func (c *Conn) query(ctx context.Context, query string) (*Rows, error) {
+	return c.rows(ctx, query, StmtOptions{})
+}
+
+// run query, reading its output as opts say
+func (c *Conn) rows(ctx context.Context, query string, opts StmtOptions) (*Rows, error) {
 	var r Rows
 
-	if query, err = subst2(s, args); err != nil {
+	if err := c.restart(ctx); err != nil {
 		return nil, err
 	}
+	c.begun = c.begun || begins(query)
 
+	// the rows are over when cancelled
+	ctx, finish := context.WithCancelCause(ctx)
 	r.ctx, r.cancel = context.WithCancel(ctx)
-	r.conn = s.conn
-	r.ch = make(chan []byte)
+	cancel := r.cancel
+	r.cancel = func() {
+		cancel()
+		finish(errReturned)
+	}
+	r.conn = c
+	r.in = make(chan []byte)
+	// chunks of output are at most readMax long, so this holds about backlog bytes
+	r.ch = make(chan []byte, c.connector.backlog/c.connector.readMax)
+	r.done = make(chan struct{})
+	r.source, _ = ctx.Value(sourceKey{}).(source)
+	r.redact = c.redactor
+	r.query = query
+	r.json = opts.JSON
+	r.rawText = opts.RawText && !opts.JSON
+	r.parseTime = opts.ParseTime
+	r.bools = opts.Booleans
+	r.rawJSON = opts.RawJSON
+	r.jsonNames = opts.JSONColumns
+	r.unsigned = opts.Unsigned
+	r.decoding = opts.decode
+	r.maxRow = c.connector.maxRow
+	r.strictInt = c.connector.strictInt
+	r.strictReal = c.connector.strictReal
+	r.exact = c.connector.exact
+	r.resync = c.connector.resync
+	r.utf8 = c.connector.utf8
+	r.more = r.fetch
+	r.fail = func(s string) error { return r.error(s) }
+	r.str = buffers.Get().(*bytes.Buffer)
+
+	if opts.headers {
+		query, r.stmts = c.prepare(query).separated()
+		r.probe = r.probeHeader
+	}
+	if opts.QualifiedNames && opts.headers {
+		query = qualify + query + unqualify
+	}
+	if r.json {
+		query = ".mode json\n" + query + "\n.mode quote\n"
+	}
+
+	// looked up now, as a query while the rows are read waits for them all
+	if opts.headers && c.connector.columnTypes || r.parseTime && c.connector.numericTime || r.bools || r.rawJSON || r.decoding && c.connector.typeDecoders {
+		r.columns = c.declared(ctx, r.query)
+	}
+	if opts.QualifiedNames && opts.headers {
+		r.qualifies = true
+		r.names = c.unqualified(r.query)
+	}
+
+	if err := c.acquire(r.ctx); err != nil {
+		return nil, err
+	}
 
 	select {
-	case s.conn.ctl <- r.job:
+	case c.ctl <- r.job:
+		c.busy = r.done
+		defer c.release(r.done)
 	case <-r.ctx.Done():
+		c.release(nil)
 		return nil, r.ctx.Err()
-	case <-s.conn.pipeline.Done():
+	case <-c.pipeline.Done():
+		c.release(nil)
 		return nil, driver.ErrBadConn
 	}
 
-	if locker := s.conn.connector.locker; locker != nil {
+	if locker := c.connector.locker; locker != nil {
 		locker.RLock()
 		defer locker.RUnlock()
 	}
 
-	r.ch <- []byte(query)
-
-	ch := make(chan []byte)
-	go buffer(r.ctx, r.ch, ch)
-	r.ch = ch
+	if !c.deliver(&r.job, query) {
+		r.cancel()
+		return nil, driver.ErrBadConn
+	}
+	c.enforce(ctx, r.done)
+	c.watch(r.redacted(query), r.done)
 
-	switch err := r.Next(nil); err {
+	switch err := r.parse(nil); err {
 	case nil, io.EOF:
 		return &r, nil
-	case io.ErrUnexpectedEOF, context.Canceled, context.DeadlineExceeded:
-		return &r, err
 	default:
-		panic(err)
+		r.cancel()
+		return nil, err
 	}
 }
 
 func (s *Stmt) NumInput() int {
-	return len(s.questions)
+	return s.inputs
 }
 
 func (s *Stmt) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for cancel := range s.running {
+		(*cancel)()
+	}
+	s.mu.Unlock()
+
+	if s.params != nil {
+		scratches.Put(&scratch{params: s.params[:0], semicolons: s.semicolons[:0]})
+		s.params, s.semicolons = nil, nil
+	}
 	return nil
 }
@@ -0,0 +1,620 @@
+package sqlite3
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// skip a test which runs sqlite3, if there's none to run
+func needSQLite(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 isn't in $PATH")
+	}
+}
+
+func TestParseHostileNames(t *testing.T) {
+	for _, tt := range []struct {
+		dsn, name, file string
+		fails           bool
+	}{
+		{dsn: "-init.db", name: "./-init.db", file: "-init.db"},
+		{dsn: "--version", name: "./--version", file: "--version"},
+		{dsn: "-", name: "./-", file: "-"},
+		{dsn: "/tmp/-abs.db", name: "/tmp/-abs.db", file: "/tmp/-abs.db"},
+		{dsn: "it's.db", name: "it's.db", file: "it's.db"},
+		{dsn: `say "hi".db`, name: `say "hi".db`, file: `say "hi".db`},
+		{dsn: "semi;colon .db", name: "semi;colon .db", file: "semi;colon .db"},
+		{dsn: "-x.db?_foreign_keys=1", name: "./-x.db", file: "-x.db"},
+		{dsn: "file:-x.db?mode=ro", name: "file:-x.db?mode=ro", file: "-x.db"},
+		{dsn: "file:it's%20here.db", name: "file:it's%20here.db", file: "it's here.db"},
+		{dsn: "file:line%0Abreak.db", name: "file:line%0Abreak.db", file: "line\nbreak.db"},
+		{dsn: ":memory:", name: ":memory:"},
+		{dsn: "app.db?mode=ro", name: "file:app.db?mode=ro", file: "app.db"},
+		{dsn: "/tmp/a b#%.db?mode=ro&_fk=1", name: "file:/tmp/a%20b%23%25.db?mode=ro", file: "/tmp/a b#%.db"},
+		{dsn: ":memory:?cache=shared", name: "file::memory:?cache=shared"},
+		{dsn: "x.db?mode=memory&cache=shared", name: "file:x.db?cache=shared&mode=memory"},
+		{dsn: "line\nbreak.db", fails: true},
+		{dsn: "carriage\rreturn.db", fails: true},
+	} {
+		var c Connector
+		err := c.parse(tt.dsn)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("parse(%q) = nil error, name %q", tt.dsn, c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parse(%q): %v", tt.dsn, err)
+			continue
+		}
+		if c.name != tt.name || c.file != tt.file {
+			t.Errorf("parse(%q) = name %q, file %q; want %q, %q", tt.dsn, c.name, c.file, tt.name, tt.file)
+		}
+	}
+}
+
+func TestOpenHostileNames(t *testing.T) {
+	needSQLite(t)
+
+	dir := t.TempDir()
+	for _, name := range []string{
+		"-init.db",
+		"--version",
+		"-",
+		"it's.db",
+		`say "hi".db`,
+		"semi;colon .db",
+		"back\\slash.db",
+		"ünïcode.db",
+	} {
+		c, err := NewConnector(name, WithDir(dir))
+		if err != nil {
+			t.Errorf("NewConnector(%q): %v", name, err)
+			continue
+		}
+		db := sql.OpenDB(c)
+
+		var got string
+		if _, err := db.Exec("CREATE TABLE t(x); INSERT INTO t VALUES ('ok')"); err != nil {
+			t.Errorf("%q: %v", name, err)
+		} else if err := db.QueryRow("SELECT x FROM t").Scan(&got); err != nil || got != "ok" {
+			t.Errorf("%q: got %q, %v", name, got, err)
+		}
+		db.Close()
+
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%q: the database isn't where it was named: %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"line\nbreak.db", "carriage\rreturn.db", "-\n.shell touch pwned"} {
+		if _, err := NewConnector(name, WithDir(dir)); err == nil {
+			t.Errorf("NewConnector(%q) = nil error", name)
+		}
+	}
+
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if e.Name() == "pwned" {
+			t.Error("a line break in a name was run as a command")
+		}
+	}
+}
+
+// sqlite3's own parameters of a plain path aren't lost
+func TestOpenPathParameters(t *testing.T) {
+	needSQLite(t)
+
+	path := filepath.Join(t.TempDir(), "a b#.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("CREATE TABLE t(x)"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = sql.Open("sqlite3", path+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("INSERT INTO t VALUES (1)"); err == nil || !strings.Contains(err.Error(), "readonly") {
+		t.Errorf("insert with mode=ro: got %v, want a readonly database", err)
+	}
+}
+
+// what sqlite3 -quote -header prints for script
+func TestUnterminatedQuote(t *testing.T) {
+	needSQLite(t)
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, tt := range []struct {
+		query     string
+		args      []any
+		token     string
+		statement int
+	}{
+		{"SELECT ? 'x", []any{1}, `'x`, 0},
+		{"SELECT 1; SELECT ?, [x", []any{1}, `[x`, 1},
+		{"SELECT ?; SELECT \"a\"\"b", []any{1}, `"a""b`, 1},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := db.ExecContext(ctx, tt.query, tt.args...)
+		cancel()
+
+		var e *Error
+		if !errors.As(err, &e) || e.Msg != `unrecognized token: "`+tt.token+`"` || e.Statement != tt.statement {
+			t.Errorf("%q: got %v, want an unrecognized token %s in statement %d", tt.query, err, tt.token, tt.statement)
+		}
+		if _, err := db.Prepare(tt.query); err == nil {
+			t.Errorf("%q: prepared", tt.query)
+		}
+	}
+}
+
+func TestExecUnterminated(t *testing.T) {
+	needSQLite(t)
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "SELECT 1 /* x"); err != nil {
+		t.Errorf("open comment: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, "SELECT 1 -- x"); err != nil {
+		t.Errorf("line comment: %v", err)
+	}
+	var e *Error
+	if _, err := db.ExecContext(ctx, "SELECT 'abc"); !errors.As(err, &e) {
+		t.Errorf("open quote: got %v, want a syntax error", err)
+	}
+	if _, err := db.QueryContext(ctx, "SELECT 'abc"); !errors.As(err, &e) {
+		t.Errorf("query with an open quote: got %v, want a syntax error", err)
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT 1 /* x").Scan(&n); err != nil || n != 1 {
+		t.Errorf("query with an open comment: got %d, %v", n, err)
+	}
+}
+
+func TestExecErrorAfterRows(t *testing.T) {
+	needSQLite(t)
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("CREATE TABLE t(a UNIQUE); INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("SELECT randomblob(200000); INSERT INTO t VALUES (1)")
+	if !errors.Is(err, ErrConstraintUnique) {
+		t.Errorf("after a large row: got %v, want a UNIQUE constraint error", err)
+	}
+	if _, err := db.Exec("SELECT 'x' || char(10) || 'Error: not one'; SELECT 1"); err != nil {
+		t.Errorf("a row with a line like an error: %v", err)
+	}
+}
+
+func TestCancelledConn(t *testing.T) {
+	needSQLite(t)
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "a.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("CREATE TABLE t(x)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// one running, and one sqlite3 waits on the END of
+	for _, query := range []string{
+		"WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c) SELECT count(*) FROM c",
+		"CREATE TRIGGER tr AFTER INSERT ON t BEGIN SELECT 1;",
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		_, err = db.ExecContext(ctx, query)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("%q: got %v, want the deadline", query, err)
+		}
+
+		// the conn's child is killed, and the pool opens another
+		start := time.Now()
+		var n int
+		if err := db.QueryRow("SELECT 7").Scan(&n); err != nil || n != 7 {
+			t.Fatalf("after %q: got %d, %v", query, n, err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("after %q: the next query took %v", query, d)
+		}
+	}
+}
+
+func TestEmptyResultSets(t *testing.T) {
+	needSQLite(t)
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "a.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("CREATE TABLE t(a, b); INSERT INTO t VALUES (1, 2)"); err != nil {
+		t.Fatal(err)
+	}
+
+	query := "SELECT a FROM t WHERE 0; CREATE TEMP TABLE u(x); SELECT b FROM t; SELECT x FROM u"
+	want := []string{"[a] 0", "[b] 1", "[x] 0"}
+	for _, opts := range []StmtOptions{{}, {JSON: true}} {
+		rows, err := db.QueryContext(WithStmtOptions(context.Background(), opts), query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for {
+			cols, _ := rows.Columns()
+			n := 0
+			for rows.Next() {
+				n++
+			}
+			got = append(got, fmt.Sprintf("%v %d", cols, n))
+			if !rows.NextResultSet() {
+				break
+			}
+		}
+		if err := rows.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("JSON %v: got %q, want %q", opts.JSON, got, want)
+		}
+		if _, err := db.Exec("DROP TABLE u"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func sqlite3Output(t *testing.T, script string) []byte {
+	t.Helper()
+	cmd := exec.Command("sqlite3", "-quote", "-header")
+	cmd.Stdin = strings.NewReader(script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("sqlite3: %v: %s", err, out)
+	}
+	return out
+}
+
+// the rows of out, each fed to a parser a piece at a time
+func parseAll(t *testing.T, out []byte, pieces int, opts ...Option) [][]any {
+	t.Helper()
+	p, err := NewParser(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rows [][]any
+	for i := 0; i < pieces; i++ {
+		p.Feed(out[len(out)*i/pieces : len(out)*(i+1)/pieces])
+		for {
+			row, err := p.Next()
+			if err == ErrIncomplete || err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%v, parsing %q", err, out)
+			}
+			values := make([]any, len(row))
+			for i, v := range row {
+				values[i] = v
+			}
+			rows = append(rows, values)
+		}
+	}
+	return rows
+}
+
+func TestParseReals(t *testing.T) {
+	for _, tt := range []struct {
+		out  string
+		want float64
+	}{
+		{"0.1000000000000000055", 0.1},
+		{"1.000000000000000015e+100", 1e100},
+		{"-2.49999999999999998e-300", -2.5e-300},
+		{"1.797693134862315692e+308", math.MaxFloat64},
+		{"4.940656458412465441e-324", math.SmallestNonzeroFloat64},
+		{"2.225073858507201383e-308", 2.2250738585072014e-308},
+		{"123456789012345680.0", 123456789012345678.0},
+		{"0.3000000000000000445", 0.30000000000000004},
+		{"1000000000000000.0", 1e15},
+		{"1.0", 1},
+		{"0.0", 0},
+		{"-7.5", -7.5},
+		{"1e5", 1e5},
+		{"1E5", 1e5},
+		{"2.5e+3", 2500},
+		{"2.5e-3", 0.0025},
+		{"-1.5E-10", -1.5e-10},
+		{"12345678901234567890123456789.0", 12345678901234567890123456789.0},
+		{"0.00000000000000000000000000001", 1e-29},
+	} {
+		rows := parseAll(t, []byte("'x'\n"+tt.out+"\n"), 1)
+		if len(rows) != 1 || len(rows[0]) != 1 {
+			t.Errorf("%s: got %v", tt.out, rows)
+			continue
+		}
+		if got, ok := rows[0][0].(float64); !ok || math.Float64bits(got) != math.Float64bits(tt.want) {
+			t.Errorf("%s: got %#v, want %v", tt.out, rows[0][0], tt.want)
+		}
+	}
+}
+
+// reals as sqlite3 computes and prints them come back exactly as Go computes
+// them; past about 1e±80, the digits sqlite3 prints may be an ulp off, so
+// they're kept within that
+func TestRealsRoundTrip(t *testing.T) {
+	needSQLite(t)
+
+	r := rand.New(rand.NewSource(1))
+	var script strings.Builder
+	var want []float64
+	script.WriteString("SELECT column1 FROM (VALUES ")
+	for i := 0; i < 2000; i++ {
+		if i > 0 {
+			script.WriteString(", ")
+		}
+		a, b := r.Int63n(1<<53)-1<<52, r.Int63n(1<<40)+1
+		// exact in IEEE arithmetic, whichever does it
+		x := float64(a) / float64(b)
+		switch i % 4 {
+		case 1:
+			x = x * float64(b) * float64(b)
+			fmt.Fprintf(&script, "(CAST(%d AS REAL) / %d * %d * %d)", a, b, b, b)
+		case 2:
+			x = math.Ldexp(x, -200)
+			fmt.Fprintf(&script, "(CAST(%d AS REAL) / %d / power(2, 200))", a, b)
+		case 3:
+			x = math.Ldexp(x, 200)
+			fmt.Fprintf(&script, "(CAST(%d AS REAL) / %d * power(2, 200))", a, b)
+		default:
+			fmt.Fprintf(&script, "(CAST(%d AS REAL) / %d)", a, b)
+		}
+		want = append(want, x)
+	}
+	script.WriteString(");\n")
+
+	out := sqlite3Output(t, script.String())
+	for _, pieces := range []int{1, 7, 1000} {
+		rows := parseAll(t, out, pieces)
+		if len(rows) != len(want) {
+			t.Fatalf("%d pieces: got %d rows, want %d", pieces, len(rows), len(want))
+		}
+		for i, row := range rows {
+			if got, ok := row[0].(float64); !ok || math.Float64bits(got) != math.Float64bits(want[i]) {
+				t.Errorf("%d pieces, row %d: got %#v, want %v", pieces, i, row[0], want[i])
+			}
+		}
+	}
+}
+
+func TestParseInfinity(t *testing.T) {
+	for _, tt := range []struct {
+		out  string
+		want float64
+	}{
+		{"Inf", math.Inf(1)},
+		{"-Inf", math.Inf(-1)},
+		{"1e999", math.Inf(1)},
+		{"-1.0e+999", math.Inf(-1)},
+		{"9.0e+999", math.Inf(1)},
+	} {
+		rows := parseAll(t, []byte("'x'\n"+tt.out+"\n"), 1)
+		if len(rows) != 1 || rows[0][0] != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.out, rows, tt.want)
+		}
+
+		p, _ := NewParser(WithStrictReals())
+		p.Feed([]byte("'x'\n" + tt.out + "\n"))
+		if row, err := p.Next(); !errors.Is(err, ErrFloatRange) {
+			t.Errorf("%s, WithStrictReals: got %v, %v, want ErrFloatRange", tt.out, row, err)
+		}
+	}
+}
+
+func TestStrictRealsResync(t *testing.T) {
+	p, _ := NewParser(WithStrictReals(), WithResync(nil))
+	p.Feed([]byte("'x','y'\n1.5,'a'\nInf,'b'\n-Inf,'c'\n2.5,'d'\n"))
+
+	var got []any
+	var failed int
+	for {
+		row, err := p.Next()
+		if errors.Is(err, ErrFloatRange) {
+			failed++
+			continue
+		} else if err != nil {
+			break
+		}
+		got = append(got, row[1])
+	}
+	if failed != 2 || fmt.Sprint(got) != "[a d]" {
+		t.Errorf("got rows %v, %d failed; want [a d], 2 failed", got, failed)
+	}
+}
+
+func TestInfinity(t *testing.T) {
+	needSQLite(t)
+
+	for _, opts := range [][]Option{nil, {WithJSON()}} {
+		c, err := NewConnector(":memory:", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db := sql.OpenDB(c)
+
+		var inf, ninf, one float64
+		if err := db.QueryRow("SELECT 9e999, -9e999, 1.0").Scan(&inf, &ninf, &one); err != nil {
+			t.Errorf("%d options: %v", len(opts), err)
+		} else if !math.IsInf(inf, 1) || !math.IsInf(ninf, -1) || one != 1 {
+			t.Errorf("%d options: got %v, %v, %v", len(opts), inf, ninf, one)
+		}
+		db.Close()
+
+		c, err = NewConnector(":memory:", append(opts, WithStrictReals())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db = sql.OpenDB(c)
+		if err := db.QueryRow("SELECT 9e999").Scan(&inf); !errors.Is(err, ErrFloatRange) {
+			t.Errorf("%d options, WithStrictReals: got %v, %v, want ErrFloatRange", len(opts), inf, err)
+		}
+		if err := db.QueryRow("SELECT 1.5").Scan(&one); err != nil || one != 1.5 {
+			t.Errorf("%d options, WithStrictReals: got %v, %v, want 1.5", len(opts), one, err)
+		}
+		db.Close()
+	}
+}
+
+// Next neither panics nor gets stuck, on any output fed in any pieces
+func FuzzParser(f *testing.F) {
+	for _, seed := range []string{
+		"'x'\n1\n",
+		"'a','b'\n1,'x'\nNULL,X'00ff'\n#\n'c'\n2.5e+10\n",
+		"'x'\n'it''s'\nInf\n-Inf\n1e999\n",
+		"'x'\n123456789012345678901234567890\n",
+		"Parse error near line 1: no such table: t\n",
+		"'x'\n'unterminated\n",
+		"'x'\n1,,2\n\x00\xff\n",
+	} {
+		f.Add([]byte(seed), int64(0), false)
+	}
+
+	f.Fuzz(func(t *testing.T, out []byte, seed int64, strict bool) {
+		var opts []Option
+		if strict {
+			opts = append(opts, WithStrictIntegers(), WithStrictReals(), WithMaxRowSize(64))
+		}
+		if seed%2 == 0 {
+			opts = append(opts, WithResync(nil))
+		}
+		p, err := NewParser(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// fed at random points, with Next called in between until it needs more;
+		// each call but those failing for good gets through a line at least
+		calls := bytes.Count(out, []byte("\n")) + 2
+		var got []string
+		r := rand.New(rand.NewSource(seed))
+		for rest := out; len(rest) > 0; {
+			n := r.Intn(len(rest)) + 1
+			p.Feed(rest[:n])
+			rest = rest[n:]
+			for i := 0; i < calls; i++ {
+				row, err := p.Next()
+				if err == ErrIncomplete {
+					break
+				}
+				got = append(got, result(p, row, err))
+			}
+		}
+		if p.resync {
+			for i := 0; ; i++ {
+				if i == calls {
+					t.Fatalf("Next hasn't run out of rows after %d calls", calls)
+				}
+				row, err := p.Next()
+				if err == ErrIncomplete {
+					break
+				}
+				got = append(got, result(p, row, err))
+			}
+		}
+
+		// the same, fed in one piece
+		whole, _ := NewParser(opts...)
+		whole.Feed(out)
+		var want []string
+		for i := 0; i < calls; i++ {
+			row, err := whole.Next()
+			if err == ErrIncomplete {
+				break
+			}
+			want = append(want, result(whole, row, err))
+		}
+
+		// without resync, a failure is returned from then on, as often as Next is called
+		if !p.resync {
+			got, want = untilError(got), untilError(want)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("fed in pieces:\n%q\nin one:\n%q", got, want)
+		}
+	})
+}
+
+// what Next gave, as it was then, for raw text & blobs are overwritten;
+// the excerpt of a ParseError depends on how much of the output is kept
+func result(p *Parser, row []driver.Value, err error) string {
+	var e *ParseError
+	switch {
+	case err == io.EOF:
+		return "EOF"
+	case errors.As(err, &e):
+		return fmt.Sprintf("error: %s, row %d, column %d", e.msg, e.Row, e.Column)
+	case err != nil:
+		return "error: " + err.Error()
+	}
+	var b strings.Builder
+	fmt.Fprint(&b, p.Columns())
+	for _, v := range row {
+		fmt.Fprintf(&b, " %T:%v", v, v)
+	}
+	return b.String()
+}
+
+// results up to the first error
+func untilError(results []string) []string {
+	for i, s := range results {
+		if strings.HasPrefix(s, "error: ") {
+			return results[:i+1]
+		}
+	}
+	return results
+}